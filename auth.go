@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"github.com/labstack/echo/v5"
+)
+
+// scopes that can be granted to API keys and JWTs
+const (
+	// scopeConvert also allows reading the templates and CSL styles
+	scopeConvert = "convert"
+	// scopeTemplatesWrite allows uploading and deleting templates and CSL
+	// styles
+	scopeTemplatesWrite = "templates:write"
+	scopeJobsRead       = "jobs:read"
+	// scopeAdmin grants all other scopes
+	scopeAdmin = "admin"
+)
+
+var validScopes = []string{scopeConvert, scopeTemplatesWrite, scopeJobsRead, scopeAdmin}
+
+// sources of a principal, also used as the key in the request log
+const (
+	principalSourceAPIKey = "api_key"
+	principalSourceJWT    = "jwt_subject"
+)
+
+// principal is an authenticated client and its permissions
+type principal struct {
+	// name is the name of the API key or the subject of the JWT
+	name   string
+	source string
+	scopes []string
+	// templates limits the templates the client can use, nil allows all
+	// templates
+	templates []string
+	// maxInputSize limits the size of the input including all resources, 0
+	// disables the limit
+	maxInputSize int64
+}
+
+// id uniquely identifies the principal. The source is included so an API key
+// and a JWT subject with the same name are different principals.
+func (p principal) id() string {
+	return p.source + ":" + p.name
+}
+
+// hasScope returns true if the principal was granted the scope or is an admin
+func (p principal) hasScope(scope string) bool {
+	return slices.Contains(p.scopes, scopeAdmin) || slices.Contains(p.scopes, scope)
+}
+
+// apiKey is a key clients use to authenticate
+type apiKey struct {
+	name   string
+	hash   []byte
+	scopes []string
+}
+
+// loadAPIKeys validates the API keys from the config
+func loadAPIKeys(keys []config.ConfigAPIKey) ([]apiKey, error) {
+	ret := make([]apiKey, 0, len(keys))
+	for i, k := range keys {
+		if k.Name == "" {
+			return nil, fmt.Errorf("api key %d: missing name", i)
+		}
+		if slices.ContainsFunc(ret, func(existing apiKey) bool { return existing.name == k.Name }) {
+			return nil, fmt.Errorf("api key %q: duplicate name", k.Name)
+		}
+		hash, err := hex.DecodeString(k.Hash)
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("api key %q: hash must be a hex encoded SHA-256 hash", k.Name)
+		}
+		if len(k.Scopes) == 0 {
+			return nil, fmt.Errorf("api key %q: no scopes configured", k.Name)
+		}
+		for _, scope := range k.Scopes {
+			if !slices.Contains(validScopes, scope) {
+				return nil, fmt.Errorf("api key %q: invalid scope %q, valid scopes are: %s", k.Name, scope, strings.Join(validScopes, ", "))
+			}
+		}
+		ret = append(ret, apiKey{
+			name:   k.Name,
+			hash:   hash,
+			scopes: k.Scopes,
+		})
+	}
+	return ret, nil
+}
+
+// findAPIKey returns the key matching the token. The hash of the token is
+// compared to all keys so the response time does not depend on the match.
+func (app *application) findAPIKey(token string) (apiKey, bool) {
+	hash := sha256.Sum256([]byte(token))
+	var found apiKey
+	ok := false
+	for _, k := range app.apiKeys {
+		if subtle.ConstantTimeCompare(hash[:], k.hash) == 1 {
+			found = k
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+// bearerToken returns the token of the Authorization header
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get(echo.HeaderAuthorization), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// authEnabled returns true if API keys or JWT validation are configured
+func (app *application) authEnabled() bool {
+	return len(app.apiKeys) > 0 || app.jwt != nil
+}
+
+// authenticate checks the API key or JWT sent by the client and if it grants
+// the scope. The principal is stored in the context for the request log and
+// the permission checks of the handlers.
+func (app *application) authenticate(c *echo.Context, scope string) error {
+	token, ok := bearerToken(c.Request())
+	if !ok {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+		return newEchoJsonError(nil, http.StatusUnauthorized, "missing bearer token")
+	}
+
+	// API keys are checked first as they can contain dots and look like a JWT
+	var p principal
+	if key, ok := app.findAPIKey(token); ok {
+		p = principal{
+			name:   key.name,
+			source: principalSourceAPIKey,
+			scopes: key.scopes,
+		}
+	} else if app.jwt != nil && looksLikeJWT(token) {
+		var err error
+		p, err = app.jwt.validate(c.Request().Context(), token)
+		if err != nil {
+			app.logger.DebugContext(c.Request().Context(), "invalid jwt", slog.String("err", err.Error()))
+			c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+			return newEchoJsonError(err, http.StatusUnauthorized, "invalid bearer token")
+		}
+	} else {
+		c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+		return newEchoJsonError(nil, http.StatusUnauthorized, "invalid bearer token")
+	}
+
+	c.Set(contextKeyPrincipal, p)
+	if !p.hasScope(scope) {
+		return newEchoJsonError(nil, http.StatusForbidden, fmt.Sprintf("bearer token is missing the %q scope", scope))
+	}
+	return nil
+}
+
+// authorizeConversion checks the conversion against the template and size
+// limits of the authenticated principal
+func (app *application) authorizeConversion(c *echo.Context, d convertRequest, conv conversion) error {
+	p, ok := c.Get(contextKeyPrincipal).(principal)
+	if !ok {
+		return nil
+	}
+
+	if p.templates != nil && conv.template != "" && !slices.Contains(p.templates, conv.template) {
+		return newEchoJsonError(nil, http.StatusForbidden, fmt.Sprintf("template %q is not allowed for this token", conv.template))
+	}
+
+	if p.maxInputSize > 0 {
+		// only the data sent by the client counts towards the limit
+		size := int64(len(d.Input))
+		for _, content := range d.Resources {
+			size += int64(len(content))
+		}
+		if size > p.maxInputSize {
+			return newEchoJsonError(nil, http.StatusRequestEntityTooLarge, fmt.Sprintf("input exceeds the size limit of %d bytes", p.maxInputSize))
+		}
+	}
+	return nil
+}
+
+// principalID returns the id of the authenticated principal or an empty string
+// if authentication is disabled
+func principalID(c *echo.Context) string {
+	p, ok := c.Get(contextKeyPrincipal).(principal)
+	if !ok {
+		return ""
+	}
+	return p.id()
+}
+
+// canAccessJob returns true if the job was created by the authenticated
+// principal. Admins can access all jobs.
+func canAccessJob(c *echo.Context, j *job) bool {
+	p, ok := c.Get(contextKeyPrincipal).(principal)
+	if !ok {
+		return j.owner == ""
+	}
+	return p.hasScope(scopeAdmin) || j.owner == p.id()
+}
+
+// requestBodyOverhead is added to the body size limit of a principal for the
+// JSON or multipart encoding, metadata and other fields of the request
+const requestBodyOverhead = 1 << 20
+
+// limitRequestBody limits the request body of a principal with a size limit
+// so oversized requests fail while the body is read instead of being read
+// into memory completely. The limit allows the base64 encoding of JSON
+// requests, authorizeConversion checks the exact size of the decoded input.
+func limitRequestBody(c *echo.Context) {
+	p, ok := c.Get(contextKeyPrincipal).(principal)
+	if !ok || p.maxInputSize <= 0 || p.maxInputSize > (math.MaxInt64-requestBodyOverhead)/4*3 {
+		return
+	}
+	limit := (p.maxInputSize+2)/3*4 + requestBodyOverhead
+	req := c.Request()
+	req.Body = http.MaxBytesReader(c.Response(), req.Body, limit)
+}
+
+// middlewareScope only allows requests with an API key or JWT granting the
+// scope. All requests are allowed if authentication is not configured.
+func (app *application) middlewareScope(scope string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			if !app.authEnabled() {
+				return next(c)
+			}
+			if err := app.authenticate(c, scope); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
+
+// middlewareSecretKeyOrScope allows requests sending the secret key header
+// like middlewareSecretKey. If authentication is configured, requests with an
+// API key or JWT granting the scope are also allowed.
+func (app *application) middlewareSecretKeyOrScope(scope string) echo.MiddlewareFunc {
+	secretKey := app.middlewareSecretKey()
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		withSecretKey := secretKey(next)
+		return func(c *echo.Context) error {
+			if !app.authEnabled() || c.Request().Header.Get(secretKeyHeaderName) != "" {
+				return withSecretKey(c)
+			}
+			if err := app.authenticate(c, scope); err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
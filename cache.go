@@ -0,0 +1,272 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	cacheStatusHit    = "hit"
+	cacheStatusMiss   = "miss"
+	cacheStatusShared = "shared"
+)
+
+type cacheEntry struct {
+	key     string
+	result  conversionResult
+	expires time.Time
+}
+
+// cacheFlight is a conversion shared by identical concurrent requests
+type cacheFlight struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	// waiters is the number of callers waiting for the result
+	waiters int
+	// done is closed once result and err are set
+	done   chan struct{}
+	result conversionResult
+	err    error
+}
+
+// conversionCache is an in-memory LRU cache for conversion results keyed by
+// a hash of the conversion. Identical concurrent conversions are merged so
+// only one of them runs pandoc.
+type conversionCache struct {
+	maxSize int64
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+	flights map[string]*cacheFlight
+}
+
+// newConversionCache creates a new cache. A maxSize of 0 disables the cache.
+func newConversionCache(maxSize int64, ttl time.Duration) *conversionCache {
+	return &conversionCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+		flights: make(map[string]*cacheFlight),
+	}
+}
+
+func (c *conversionCache) enabled() bool {
+	return c.maxSize > 0
+}
+
+// do returns the cached result of the conversion or calls fn to create it.
+// The returned status is one of the cacheStatus constants or empty if the
+// cache is disabled. If identical conversions are requested concurrently
+// only the first one calls fn. fn runs on a context that is independent of
+// the individual callers, every caller stops waiting once its own ctx is done
+// and the conversion is cancelled when no caller is waiting anymore. The
+// conversion itself is limited by the command timeout of the converters.
+func (c *conversionCache) do(ctx context.Context, conv conversion, fn func(ctx context.Context) (conversionResult, error)) (conversionResult, string, error) {
+	if !c.enabled() {
+		result, err := fn(ctx)
+		return result, "", err
+	}
+
+	key := cacheKey(conv)
+	if result, ok := c.get(key); ok {
+		metricCacheRequests.WithLabelValues(cacheStatusHit).Inc()
+		return result, cacheStatusHit, nil
+	}
+
+	f, first := c.joinFlight(ctx, key)
+	defer c.leaveFlight(key, f)
+
+	status := cacheStatusShared
+	if first {
+		status = cacheStatusMiss
+		go c.runFlight(key, f, fn)
+	}
+
+	select {
+	case <-ctx.Done():
+		return conversionResult{}, "", ctx.Err()
+	case <-f.done:
+		metricCacheRequests.WithLabelValues(status).Inc()
+		if f.err != nil {
+			return conversionResult{}, status, f.err
+		}
+		return f.result, status, nil
+	}
+}
+
+// runFlight runs the conversion of the flight and stores the result
+func (c *conversionCache) runFlight(key string, f *cacheFlight, fn func(ctx context.Context) (conversionResult, error)) {
+	result, err := fn(f.ctx)
+	f.cancel()
+	if err == nil {
+		c.add(key, result)
+	}
+
+	// callers arriving from now on use the cached result
+	c.mu.Lock()
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	c.mu.Unlock()
+
+	f.result, f.err = result, err
+	close(f.done)
+}
+
+// joinFlight registers the caller as waiting for the conversion with the
+// key. It returns true if the caller is the first one and needs to start the
+// conversion. The context of the first caller is used for the values like the
+// request id and the trace, but its cancellation is not inherited.
+func (c *conversionCache) joinFlight(ctx context.Context, key string) (*cacheFlight, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.flights[key]
+	if !ok {
+		flightCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+		f = &cacheFlight{ctx: flightCtx, cancel: cancel, done: make(chan struct{})}
+		c.flights[key] = f
+	}
+	f.waiters++
+	return f, !ok
+}
+
+// leaveFlight removes the caller from the conversion and cancels it if it
+// was the last caller waiting for it
+func (c *conversionCache) leaveFlight(key string, f *cacheFlight) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f.waiters--
+	if f.waiters > 0 {
+		return
+	}
+	// new callers must not join the cancelled conversion
+	if c.flights[key] == f {
+		delete(c.flights, key)
+	}
+	f.cancel()
+}
+
+func (c *conversionCache) get(key string) (conversionResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return conversionResult{}, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.removeElement(elem)
+		return conversionResult{}, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.result, true
+}
+
+func (c *conversionCache) add(key string, result conversionResult) {
+	size := int64(len(result.content))
+	// never cache results that would evict the whole cache
+	if size > c.maxSize {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.removeElement(elem)
+	}
+
+	elem := c.lru.PushFront(&cacheEntry{
+		key:     key,
+		result:  result,
+		expires: time.Now().Add(c.ttl),
+	})
+	c.entries[key] = elem
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.removeElement(c.lru.Back())
+	}
+}
+
+// removeElement removes the element from the cache. c.mu must be held.
+func (c *conversionCache) removeElement(elem *list.Element) {
+	entry := elem.Value.(*cacheEntry)
+	c.lru.Remove(elem)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.result.content))
+}
+
+// cacheKey returns a hash over all fields of the conversion that influence
+// the result. New fields of conversion need to be added here.
+func cacheKey(conv conversion) string {
+	h := sha256.New()
+	writeHashField(h, conv.input)
+	writeHashField(h, []byte(conv.inputFormat.spec))
+	writeHashField(h, []byte(conv.outputFormat.writer))
+	writeHashField(h, []byte(conv.outputFormat.extension))
+	writeHashField(h, []byte(conv.template))
+	writeHashField(h, conv.templateContent)
+	writeHashField(h, []byte(conv.templateFormat))
+	writeHashField(h, []byte(conv.templateFile))
+	writeHashField(h, binary.BigEndian.AppendUint64(nil, uint64(len(conv.args))))
+	for _, arg := range conv.args {
+		writeHashField(h, []byte(arg))
+	}
+	// json.Marshal sorts the map keys so the output is stable
+	metadata, _ := json.Marshal(conv.metadata)
+	writeHashField(h, metadata)
+	writeHashField(h, conv.defaults)
+	writeHashField(h, []byte(conv.pdfEngine))
+	writeHashField(h, binary.BigEndian.AppendUint64(nil, uint64(len(conv.pdfEngineOpts))))
+	for _, opt := range conv.pdfEngineOpts {
+		writeHashField(h, []byte(opt))
+	}
+	writeHashField(h, []byte(strconv.FormatBool(conv.citeproc)))
+	writeHashField(h, binary.BigEndian.AppendUint64(nil, uint64(len(conv.bibliography))))
+	for _, bibliography := range conv.bibliography {
+		writeHashField(h, []byte(bibliography))
+	}
+	writeHashField(h, []byte(conv.csl))
+	writeHashField(h, binary.BigEndian.AppendUint64(nil, uint64(len(conv.luaFilters))))
+	for _, filter := range conv.luaFilters {
+		writeHashField(h, []byte(filter))
+	}
+
+	names := make([]string, 0, len(conv.resources))
+	for name := range conv.resources {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		writeHashField(h, []byte(name))
+		writeHashField(h, conv.resources[name])
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeHashField writes the length of the value before the value itself so
+// different field boundaries can not produce the same hash
+func writeHashField(h hash.Hash, value []byte) {
+	var length [8]byte
+	binary.BigEndian.PutUint64(length[:], uint64(len(value)))
+	h.Write(length[:])
+	h.Write(value)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitForFlightWaiters waits until the number of callers waiting for the
+// conversion reaches n
+func waitForFlightWaiters(t *testing.T, c *conversionCache, conv conversion, n int) {
+	t.Helper()
+	key := cacheKey(conv)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c.mu.Lock()
+		waiters := 0
+		if f, ok := c.flights[key]; ok {
+			waiters = f.waiters
+		}
+		c.mu.Unlock()
+		if waiters == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d callers waiting for the conversion, got %d", n, waiters)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCacheSharedConversionSurvivesCancelledCaller(t *testing.T) {
+	c := newConversionCache(1<<20, time.Minute)
+	conv := conversion{input: []byte("doc")}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	fnCtxErr := make(chan error, 1)
+	fn := func(ctx context.Context) (conversionResult, error) {
+		close(started)
+		select {
+		case <-release:
+		case <-ctx.Done():
+		}
+		fnCtxErr <- ctx.Err()
+		return conversionResult{content: []byte("result")}, ctx.Err()
+	}
+
+	// the first caller starts the conversion and gives up while it is running
+	firstCtx, cancelFirst := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.do(firstCtx, conv, fn)
+		firstErr <- err
+	}()
+	<-started
+
+	secondResult := make(chan conversionResult, 1)
+	go func() {
+		result, status, err := c.do(context.Background(), conv, func(context.Context) (conversionResult, error) {
+			t.Error("identical conversion was not merged")
+			return conversionResult{}, nil
+		})
+		if err != nil || status != cacheStatusShared {
+			t.Errorf("unexpected status %q and error %v", status, err)
+		}
+		secondResult <- result
+	}()
+	waitForFlightWaiters(t, c, conv, 2)
+
+	cancelFirst()
+	select {
+	case err := <-firstErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled for the first caller, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("first caller did not stop waiting after its context was cancelled")
+	}
+
+	close(release)
+	if err := <-fnCtxErr; err != nil {
+		t.Fatalf("conversion was cancelled with the first caller: %v", err)
+	}
+	if result := <-secondResult; string(result.content) != "result" {
+		t.Errorf("unexpected result %q", result.content)
+	}
+
+	result, status, err := c.do(context.Background(), conv, func(context.Context) (conversionResult, error) {
+		t.Error("cached conversion was run again")
+		return conversionResult{}, nil
+	})
+	if err != nil || status != cacheStatusHit || string(result.content) != "result" {
+		t.Errorf("expected a cache hit, got %q %q %v", result.content, status, err)
+	}
+}
+
+func TestCacheConversionCancelledWithoutCallers(t *testing.T) {
+	c := newConversionCache(1<<20, time.Minute)
+	conv := conversion{input: []byte("doc")}
+
+	started := make(chan struct{})
+	fnCtxErr := make(chan error, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		_, _, _ = c.do(ctx, conv, func(ctx context.Context) (conversionResult, error) {
+			close(started)
+			<-ctx.Done()
+			fnCtxErr <- ctx.Err()
+			return conversionResult{}, ctx.Err()
+		})
+	}()
+	<-started
+	cancel()
+
+	select {
+	case err := <-fnCtxErr:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("conversion was not cancelled after the last caller left")
+	}
+
+	// a new caller must start a new conversion instead of joining the
+	// cancelled one
+	result, status, err := c.do(context.Background(), conv, func(context.Context) (conversionResult, error) {
+		return conversionResult{content: []byte("new")}, nil
+	})
+	if err != nil || status != cacheStatusMiss || string(result.content) != "new" {
+		t.Errorf("expected a new conversion, got %q %q %v", result.content, status, err)
+	}
+}
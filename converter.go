@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// errConversionTimeout is returned if the conversion took longer than the
+// configured command timeout
+var errConversionTimeout = errors.New("conversion timed out")
+
+// converter is implemented by all conversion backends
+type converter interface {
+	convert(ctx context.Context, conv conversion) (conversionResult, error)
+}
+
+// conversion is a validated conversion request
+type conversion struct {
+	input       []byte
+	inputFormat inputFormat
+	resources   map[string][]byte
+	template    string
+	// templateContent and templateFormat are set for uploaded templates
+	// and take precedence over template
+	templateContent []byte
+	templateFormat  string
+	// templateFile is the absolute path of a builtin template so it can not
+	// be shadowed by a resource in the working directory
+	templateFile string
+	outputFormat outputFormat
+	// metadata is passed to pandoc as metadata file so values in the
+	// document take precedence
+	metadata map[string]any
+	// args are additional pandoc arguments from the profile
+	args []string
+	// defaults is a validated pandoc defaults file
+	defaults []byte
+	// pdfEngine is empty for the pandoc default engine
+	pdfEngine     string
+	pdfEngineOpts []string
+	// citeproc enables citation processing, bibliography and csl are
+	// relative paths to resources
+	citeproc     bool
+	bibliography []string
+	csl          string
+	// luaFilters are the absolute paths of the registered filters in the
+	// order they are applied
+	luaFilters []string
+}
+
+// conversionResult holds the converted document
+type conversionResult struct {
+	content     []byte
+	diagnostics []diagnostic
+}
+
+// newConverter returns the converter running the local pandoc binary. If a
+// pandoc-server is configured the supported conversions are forwarded to it.
+// Background tasks of the converter are stopped when ctx is done.
+func newConverter(ctx context.Context, configuration config.Configuration, logger *slog.Logger) converter {
+	execConverter := newExecConverter(configuration, logger)
+	if configuration.PandocServer.URL == "" {
+		return execConverter
+	}
+	logger.Info("Converter: using pandoc-server", slog.String("url", configuration.PandocServer.URL))
+	pandocServer := newPandocServerConverter(configuration, logger)
+	go pandocServer.healthLoop(ctx, configuration.PandocServer.HealthCheckInterval)
+	return &routingConverter{
+		exec:         execConverter,
+		pandocServer: pandocServer,
+	}
+}
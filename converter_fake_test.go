@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// fakeConverter is an in-memory converter used in the tests instead of
+// pandoc. It returns the input document as the result and records all
+// conversions.
+type fakeConverter struct {
+	// err is returned instead of a result if set
+	err error
+	// block makes conversions wait until it is closed
+	block chan struct{}
+
+	mu          sync.Mutex
+	conversions []conversion
+}
+
+func (c *fakeConverter) convert(ctx context.Context, conv conversion) (conversionResult, error) {
+	c.mu.Lock()
+	c.conversions = append(c.conversions, conv)
+	c.mu.Unlock()
+
+	if c.block != nil {
+		select {
+		case <-c.block:
+		case <-ctx.Done():
+			return conversionResult{}, ctx.Err()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return conversionResult{}, err
+	}
+	if c.err != nil {
+		return conversionResult{}, c.err
+	}
+	return conversionResult{content: conv.input}, nil
+}
+
+// calls returns the conversions passed to the converter
+func (c *fakeConverter) calls() []conversion {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]conversion(nil), c.conversions...)
+}
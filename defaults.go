@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+var errInvalidDefaults = errors.New("invalid defaults")
+
+// defaultsOptionKind describes how the value of a defaults option is validated
+type defaultsOptionKind int
+
+const (
+	// defaultsValue options can contain any value
+	defaultsValue defaultsOptionKind = iota
+	// defaultsPath options contain a single file path
+	defaultsPath
+	// defaultsPaths options contain a single file path or a list of paths
+	defaultsPaths
+)
+
+// defaultsOptions is the list of options clients are allowed to set in a
+// defaults file. Everything else is rejected, especially options that
+// change the input and output files, the data dir, the template or the
+// pdf engine and filters as they would allow running code sent by the client.
+// All paths need to point to files inside the working directory.
+var defaultsOptions = map[string]defaultsOptionKind{
+	"metadata":                defaultsValue,
+	"variables":               defaultsValue,
+	"standalone":              defaultsValue,
+	"file-scope":              defaultsValue,
+	"fail-if-warnings":        defaultsValue,
+	"citeproc":                defaultsValue,
+	"cite-method":             defaultsValue,
+	"toc":                     defaultsValue,
+	"table-of-contents":       defaultsValue,
+	"toc-depth":               defaultsValue,
+	"number-sections":         defaultsValue,
+	"number-offset":           defaultsValue,
+	"shift-heading-level-by":  defaultsValue,
+	"section-divs":            defaultsValue,
+	"identifier-prefix":       defaultsValue,
+	"title-prefix":            defaultsValue,
+	"top-level-division":      defaultsValue,
+	"html-math-method":        defaultsValue,
+	"html-q-tags":             defaultsValue,
+	"email-obfuscation":       defaultsValue,
+	"ascii":                   defaultsValue,
+	"wrap":                    defaultsValue,
+	"columns":                 defaultsValue,
+	"dpi":                     defaultsValue,
+	"eol":                     defaultsValue,
+	"tab-stop":                defaultsValue,
+	"preserve-tabs":           defaultsValue,
+	"strip-comments":          defaultsValue,
+	"indented-code-classes":   defaultsValue,
+	"default-image-extension": defaultsValue,
+	"incremental":             defaultsValue,
+	"slide-level":             defaultsValue,
+	"reference-links":         defaultsValue,
+	"reference-location":      defaultsValue,
+	"markdown-headings":       defaultsValue,
+	"list-tables":             defaultsValue,
+	"track-changes":           defaultsValue,
+	"link-images":             defaultsValue,
+	"embed-resources":         defaultsValue,
+	"epub-chapter-level":      defaultsValue,
+	"epub-title-page":         defaultsValue,
+	"split-level":             defaultsValue,
+	"ipynb-output":            defaultsValue,
+	"highlight-style":         defaultsPath,
+	"reference-doc":           defaultsPath,
+	"csl":                     defaultsPath,
+	"citation-abbreviations":  defaultsPath,
+	"abbreviations":           defaultsPath,
+	"epub-cover-image":        defaultsPath,
+	"epub-metadata":           defaultsPath,
+	"bibliography":            defaultsPaths,
+	"css":                     defaultsPaths,
+	"include-in-header":       defaultsPaths,
+	"include-before-body":     defaultsPaths,
+	"include-after-body":      defaultsPaths,
+	"syntax-definitions":      defaultsPaths,
+	"epub-fonts":              defaultsPaths,
+	"resource-path":           defaultsPaths,
+}
+
+// parseDefaults parses and validates a pandoc defaults file sent by the
+// client. The validated options are marshalled again so pandoc sees exactly
+// what was validated.
+func parseDefaults(content []byte) ([]byte, error) {
+	var defaults map[string]any
+	if err := yaml.Unmarshal(content, &defaults); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidDefaults, err)
+	}
+	if len(defaults) == 0 {
+		return nil, nil
+	}
+
+	keys := make([]string, 0, len(defaults))
+	for key := range defaults {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		kind, ok := defaultsOptions[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: option %q is not allowed", errInvalidDefaults, key)
+		}
+		if err := validateDefaultsOption(kind, defaults[key]); err != nil {
+			return nil, fmt.Errorf("%w: option %q: %w", errInvalidDefaults, key, err)
+		}
+	}
+
+	ret, err := yaml.Marshal(defaults)
+	if err != nil {
+		return nil, fmt.Errorf("could not marshal defaults: %w", err)
+	}
+	return ret, nil
+}
+
+func validateDefaultsOption(kind defaultsOptionKind, value any) error {
+	switch kind {
+	case defaultsPath:
+		return validateDefaultsPath(value)
+	case defaultsPaths:
+		list, ok := value.([]any)
+		if !ok {
+			return validateDefaultsPath(value)
+		}
+		for _, v := range list {
+			if err := validateDefaultsPath(v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateDefaultsPath makes sure the path is a relative path inside the
+// working directory. Pandoc expands environment variables like ${HOME} in
+// paths so they are not allowed either.
+func validateDefaultsPath(value any) error {
+	p, ok := value.(string)
+	if !ok {
+		return errors.New("expected a path")
+	}
+	if strings.Contains(p, "$") || !filepath.IsLocal(p) {
+		return fmt.Errorf("path %q is not a relative path inside the working directory", p)
+	}
+	return nil
+}
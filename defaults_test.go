@@ -0,0 +1,74 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"go.yaml.in/yaml/v3"
+)
+
+func TestParseDefaults(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "empty", content: ""},
+		{name: "values", content: "toc: true\nnumber-sections: true\nvariables:\n  fontsize: 12pt\nmetadata:\n  title: $title$\n"},
+		{name: "relative path", content: "reference-doc: templates/reference.docx\n"},
+		{name: "list of relative paths", content: "css:\n  - styles/print.css\n  - screen.css\n"},
+		{name: "single path for a list option", content: "bibliography: references.bib\n"},
+		{name: "citations", content: "citeproc: true\ncsl: apa.csl\nbibliography: [a.bib, b.yaml]\n"},
+
+		{name: "output file", content: "output-file: /tmp/out.pdf\n", wantErr: true},
+		{name: "input files", content: "input-files: [/etc/passwd]\n", wantErr: true},
+		{name: "data dir", content: "data-dir: /tmp\n", wantErr: true},
+		{name: "filters", content: "filters: [evil.lua]\n", wantErr: true},
+		{name: "template", content: "template: /etc/passwd\n", wantErr: true},
+		{name: "pdf engine", content: "pdf-engine: /bin/sh\n", wantErr: true},
+		{name: "pdf engine options", content: "pdf-engine-opts: [-shell-escape]\n", wantErr: true},
+		{name: "nested defaults", content: "defaults: other.yaml\n", wantErr: true},
+		{name: "unknown option", content: "no-such-option: true\n", wantErr: true},
+		{name: "environment variable", content: "css: ${HOME}/.ssh/id_rsa\n", wantErr: true},
+		{name: "data dir variable", content: "reference-doc: ${USERDATA}/reference.docx\n", wantErr: true},
+		{name: "dollar sign", content: "csl: $HOME/apa.csl\n", wantErr: true},
+		{name: "absolute path", content: "reference-doc: /etc/passwd\n", wantErr: true},
+		{name: "parent directory", content: "include-in-header: ../secret.tex\n", wantErr: true},
+		{name: "parent directory inside a path", content: "css: styles/../../secret.css\n", wantErr: true},
+		{name: "invalid path in a list", content: "bibliography: [a.bib, /etc/passwd]\n", wantErr: true},
+		{name: "path is not a string", content: "reference-doc: {file: a.docx}\n", wantErr: true},
+		{name: "invalid yaml", content: "toc: [true\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ret, err := parseDefaults([]byte(tt.content))
+			if tt.wantErr {
+				if !errors.Is(err, errInvalidDefaults) {
+					t.Fatalf("expected an invalid defaults error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.content == "" {
+				if ret != nil {
+					t.Errorf("expected no defaults, got %q", ret)
+				}
+				return
+			}
+
+			// pandoc gets exactly the validated options
+			var got, want map[string]any
+			if err := yaml.Unmarshal(ret, &got); err != nil {
+				t.Fatal(err)
+			}
+			if err := yaml.Unmarshal([]byte(tt.content), &want); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(want) {
+				t.Errorf("expected %v, got %v", want, got)
+			}
+		})
+	}
+}
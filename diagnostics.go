@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	diagnosticLevelWarning = "warning"
+	diagnosticLevelError   = "error"
+
+	// diagnosticSourceLatex is used for errors from the LaTeX engine, the
+	// line refers to the generated LaTeX document
+	diagnosticSourceLatex = "latex"
+)
+
+// diagnostic is a warning or error reported by pandoc or the pdf engine
+type diagnostic struct {
+	Level   string `json:"level"`
+	Type    string `json:"type,omitempty"`
+	Message string `json:"message"`
+	Source  string `json:"source,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// diagnosticsError is returned if a conversion failed and holds the
+// diagnostics collected until the failure
+type diagnosticsError struct {
+	err         error
+	diagnostics []diagnostic
+}
+
+func (e *diagnosticsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *diagnosticsError) Unwrap() error {
+	return e.err
+}
+
+// parsePandocLog parses the JSON log written by pandoc using --log. Every
+// message contains the verbosity and the type, all other fields depend on
+// the type and are added to the message. Info messages are skipped.
+func parsePandocLog(content []byte) ([]diagnostic, error) {
+	if len(content) == 0 {
+		return nil, nil
+	}
+
+	var messages []map[string]any
+	if err := json.Unmarshal(content, &messages); err != nil {
+		return nil, fmt.Errorf("could not parse pandoc log: %w", err)
+	}
+
+	var diagnostics []diagnostic
+	for _, message := range messages {
+		verbosity, _ := message["verbosity"].(string)
+		var level string
+		switch verbosity {
+		case "WARNING":
+			level = diagnosticLevelWarning
+		case "ERROR":
+			level = diagnosticLevelError
+		default:
+			continue
+		}
+
+		d := diagnostic{
+			Level: level,
+		}
+		d.Type, _ = message["type"].(string)
+		d.Source, _ = message["source"].(string)
+		if line, ok := message["line"].(float64); ok {
+			d.Line = int(line)
+		}
+		if column, ok := message["column"].(float64); ok {
+			d.Column = int(column)
+		}
+
+		var parts []string
+		for _, key := range slices.Sorted(maps.Keys(message)) {
+			switch key {
+			case "verbosity", "type", "source", "line", "column":
+				continue
+			}
+			parts = append(parts, fmt.Sprintf("%s: %v", key, message[key]))
+		}
+		d.Message = strings.Join(parts, ", ")
+		if d.Message == "" {
+			d.Message = d.Type
+		}
+		diagnostics = append(diagnostics, d)
+	}
+	return diagnostics, nil
+}
+
+// parseLatexErrors extracts the errors from the LaTeX output pandoc prints
+// if the pdf could not be created. LaTeX errors start with an exclamation
+// mark and are followed by the line number in the form "l.42 ...".
+func parseLatexErrors(stderr string) []diagnostic {
+	var diagnostics []diagnostic
+	scanner := bufio.NewScanner(strings.NewReader(stderr))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if message, ok := strings.CutPrefix(line, "! "); ok {
+			diagnostics = append(diagnostics, diagnostic{
+				Level:   diagnosticLevelError,
+				Message: strings.TrimSpace(message),
+				Source:  diagnosticSourceLatex,
+			})
+			continue
+		}
+		if len(diagnostics) == 0 || diagnostics[len(diagnostics)-1].Line != 0 {
+			continue
+		}
+		// the line number belongs to the last error
+		if rest, ok := strings.CutPrefix(line, "l."); ok {
+			number, _, _ := strings.Cut(rest, " ")
+			if n, err := strconv.Atoi(number); err == nil {
+				diagnostics[len(diagnostics)-1].Line = n
+			}
+		}
+	}
+	return diagnostics
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestParsePandocLog(t *testing.T) {
+	// written by pandoc 3 using --log
+	content := []byte(`[
+{"type":"LoadedResource","verbosity":"INFO","for":"images/logo.png","from":"images/logo.png"},
+{"type":"CouldNotFetchResource","verbosity":"WARNING","path":"missing.png","message":"replacing image with description"},
+{"type":"SkippedContent","verbosity":"WARNING","contents":"\\foo","source":"input.md","line":3,"column":1},
+{"type":"NoTitleElement","verbosity":"WARNING","fallback":"input"},
+{"type":"CouldNotConvertImage","verbosity":"ERROR","path":"diagram.svg","message":"check that rsvg-convert is in path"}
+]`)
+
+	got, err := parsePandocLog(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []diagnostic{
+		{Level: diagnosticLevelWarning, Type: "CouldNotFetchResource", Message: "message: replacing image with description, path: missing.png"},
+		{Level: diagnosticLevelWarning, Type: "SkippedContent", Message: `contents: \foo`, Source: "input.md", Line: 3, Column: 1},
+		{Level: diagnosticLevelWarning, Type: "NoTitleElement", Message: "fallback: input"},
+		{Level: diagnosticLevelError, Type: "CouldNotConvertImage", Message: "message: check that rsvg-convert is in path, path: diagram.svg"},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected diagnostics\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+func TestParsePandocLogInvalid(t *testing.T) {
+	if diagnostics, err := parsePandocLog(nil); err != nil || diagnostics != nil {
+		t.Errorf("expected no diagnostics for an empty log, got %v %v", diagnostics, err)
+	}
+	for _, content := range []string{"not json", `{"type":"object"}`, `[{"type":`} {
+		if _, err := parsePandocLog([]byte(content)); err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+	// unexpected field types are ignored
+	got, err := parsePandocLog([]byte(`[{"verbosity":"WARNING","type":1,"line":"3"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Type != "" || got[0].Line != 0 || got[0].Level != diagnosticLevelWarning {
+		t.Errorf("unexpected diagnostics %+v", got)
+	}
+}
+
+func TestParseLatexErrors(t *testing.T) {
+	// printed by pandoc if xelatex fails
+	stderr := `Error producing PDF.
+! Undefined control sequence.
+l.42 \foo
+         
+! LaTeX Error: File ` + "`missing.sty'" + ` not found.
+
+Type X to quit or <RETURN> to proceed,
+or enter new name. (Default extension: sty)
+
+Enter file name: 
+! Emergency stop.
+<read > 
+        
+l.5 \usepackage
+               {missing}^^M
+`
+	got := parseLatexErrors(stderr)
+	want := []diagnostic{
+		{Level: diagnosticLevelError, Message: "Undefined control sequence.", Source: diagnosticSourceLatex, Line: 42},
+		{Level: diagnosticLevelError, Message: "LaTeX Error: File `missing.sty' not found.", Source: diagnosticSourceLatex},
+		{Level: diagnosticLevelError, Message: "Emergency stop.", Source: diagnosticSourceLatex, Line: 5},
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("unexpected diagnostics\n got: %+v\nwant: %+v", got, want)
+	}
+
+	if got := parseLatexErrors("[WARNING] Missing character: There is no ñ in font\nl.3 text"); got != nil {
+		t.Errorf("expected no diagnostics without errors, got %+v", got)
+	}
+}
@@ -15,21 +15,35 @@ type echoJsonError struct {
 	err         error
 	code        int
 	userMessage string
+	// errorCode is an optional machine readable error code sent to the client
+	errorCode string
+	// diagnostics are the warnings and errors of a failed conversion
+	diagnostics []diagnostic
 }
 
-func (e echoJsonError) Error() string {
+func (e *echoJsonError) Error() string {
 	return e.userMessage
 }
 
-func newEchoJsonError(err error, code int, message string) echoJsonError {
-	return echoJsonError{
+func (e *echoJsonError) Unwrap() error {
+	return e.err
+}
+
+func newEchoJsonError(err error, code int, message string) *echoJsonError {
+	return &echoJsonError{
 		err:         err,
 		code:        code,
 		userMessage: message,
 	}
 }
 
-func (app *application) newServer(ctx context.Context) http.Handler {
+func newEchoJsonErrorWithCode(err error, code int, errorCode, message string) *echoJsonError {
+	e := newEchoJsonError(err, code, message)
+	e.errorCode = errorCode
+	return e
+}
+
+func (app *application) newServer() http.Handler {
 	e := echo.New()
 	e.HTTPErrorHandler = app.customHTTPErrorHandler
 
@@ -37,7 +51,9 @@ func (app *application) newServer(ctx context.Context) http.Handler {
 		e.IPExtractor = extractIPFromCloudflareHeader()
 	}
 
-	e.Use(app.middlewareRequestLogger(ctx))
+	e.Use(app.middlewareRequestID())
+	e.Use(app.middlewareTracing())
+	e.Use(app.middlewareRequestLogger())
 	e.Use(middleware.Secure())
 	e.Use(app.middlewareRecover())
 
@@ -54,37 +70,55 @@ func (app *application) customHTTPErrorHandler(c *echo.Context, err error) {
 	}
 
 	type jsonErrorResponse struct {
-		Error string `json:"error"`
+		Error       string       `json:"error"`
+		Code        string       `json:"code,omitempty"`
+		Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+		RequestID   string       `json:"request_id,omitempty"`
 	}
 
 	code := http.StatusInternalServerError
 	msg := "error occured - please see log"
+	errorCode := ""
+	var diagnostics []diagnostic
 	var echoError *echo.HTTPError
 	var jsonError *echoJsonError
 	switch {
-	case errors.As(err, &echoError):
-		code = echoError.Code
-		msg = fmt.Sprintf("%v", echoError.Message)
 	case errors.As(err, &jsonError):
 		code = jsonError.code
 		msg = jsonError.userMessage
+		errorCode = jsonError.errorCode
+		diagnostics = jsonError.diagnostics
+	case errors.As(err, &echoError):
+		code = echoError.Code
+		msg = fmt.Sprintf("%v", echoError.Message)
 	}
 
+	ctx := c.Request().Context()
+	requestID := requestIDFromContext(ctx)
+
 	// send an asynchronous notification (but ignore 404 and stuff)
-	if err != nil && code > 499 {
-		app.logger.Error("error on request", slog.String("err", err.Error()))
+	// 503 is returned if the server is busy so this is also not worth a notification
+	if err != nil && code > 499 && code != http.StatusServiceUnavailable {
+		app.logger.ErrorContext(ctx, "error on request", slog.String("err", err.Error()))
 
 		go func(e error) {
-			app.logger.Debug("sending error notification", slog.String("err", e.Error()))
-			if err2 := app.notify.Send(context.Background(), "ERROR", e.Error()); err2 != nil {
-				app.logger.Error("error on notification send", slog.String("err", err2.Error()))
+			// the request context is cancelled once the response is sent
+			notifyCtx := withRequestID(context.Background(), requestID)
+			app.logger.DebugContext(notifyCtx, "sending error notification", slog.String("err", e.Error()))
+			message := e.Error()
+			if requestID != "" {
+				message = fmt.Sprintf("%s\n\nRequest ID: %s", message, requestID)
+			}
+			if err2 := app.notify.Send(notifyCtx, "ERROR", message); err2 != nil {
+				metricNotificationFailures.Inc()
+				app.logger.ErrorContext(notifyCtx, "error on notification send", slog.String("err", err2.Error()))
 			}
 		}(err)
 	}
 
 	// send error json
-	if err2 := c.JSON(code, jsonErrorResponse{Error: msg}); err2 != nil {
-		app.logger.Error("could not send error page", slog.String("err", err2.Error()))
+	if err2 := c.JSON(code, jsonErrorResponse{Error: msg, Code: errorCode, Diagnostics: diagnostics, RequestID: requestID}); err2 != nil {
+		app.logger.ErrorContext(ctx, "could not send error page", slog.String("err", err2.Error()))
 		return
 	}
 }
@@ -1,10 +1,26 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"math"
+	"mime"
+	"mime/multipart"
 	"net/http"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/labstack/echo/v5"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func (app *application) handleHealth(c *echo.Context) error {
@@ -20,11 +36,11 @@ func (app *application) handleTestPanic(c *echo.Context) error {
 	headerValue := c.Request().Header.Get(secretKeyHeaderName)
 	switch headerValue {
 	case "":
-		app.logger.Error("test_panic called without secret header")
+		app.logger.ErrorContext(c.Request().Context(), "test_panic called without secret header")
 	case app.config.Notifications.SecretKeyHeader:
 		panic("test")
 	default:
-		app.logger.Error("test_panic called without valid header")
+		app.logger.ErrorContext(c.Request().Context(), "test_panic called without valid header")
 	}
 	return c.Render(http.StatusOK, "index.html", nil)
 }
@@ -38,11 +54,831 @@ func (app *application) handleTestNotification(c *echo.Context) error {
 	headerValue := c.Request().Header.Get(secretKeyHeaderName)
 	switch headerValue {
 	case "":
-		app.logger.Error("test_notification called without secret header")
+		app.logger.ErrorContext(c.Request().Context(), "test_notification called without secret header")
 	case app.config.Notifications.SecretKeyHeader:
 		return fmt.Errorf("test")
 	default:
-		app.logger.Error("test_notification called without valid header")
+		app.logger.ErrorContext(c.Request().Context(), "test_notification called without valid header")
 	}
 	return c.Render(http.StatusOK, "index.html", nil)
 }
+
+// convertRequest holds the parameters of a conversion, regardless of
+// whether it was sent as JSON or as multipart/form-data
+type convertRequest struct {
+	Input         []byte            `json:"input"`
+	InputFormat   string            `json:"input_format"`
+	Resources     map[string][]byte `json:"resources"`
+	Template      string            `json:"template"`
+	OutputFormat  string            `json:"output_format"`
+	CallbackURL   string            `json:"callback_url"`
+	Profile       string            `json:"profile"`
+	Metadata      map[string]any    `json:"metadata"`
+	Defaults      string            `json:"defaults"`
+	PDFEngine     string            `json:"pdf_engine"`
+	PDFEngineOpts []string          `json:"pdf_engine_opts"`
+	Citeproc      bool              `json:"citeproc"`
+	Bibliography  []string          `json:"bibliography"`
+	CSL           string            `json:"csl"`
+	Filters       []string          `json:"filters"`
+}
+
+// bindConvertRequest reads the conversion parameters from a JSON body or a
+// multipart/form-data upload
+func (app *application) bindConvertRequest(c *echo.Context) (convertRequest, error) {
+	limitRequestBody(c)
+	if !strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), echo.MIMEMultipartForm) {
+		var d convertRequest
+		if err := c.Bind(&d); err != nil {
+			return convertRequest{}, err
+		}
+		return d, nil
+	}
+
+	return bindMultipartConvertRequest(c.Request())
+}
+
+// bindError returns the response for a conversion request that could not be
+// read. Requests exceeding the body size limit get a 413 status code.
+func bindError(err error) error {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return newEchoJsonError(err, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds the size limit of %d bytes", maxBytesErr.Limit))
+	}
+	return newEchoJsonError(err, http.StatusBadRequest, "invalid input")
+}
+
+// resourceFieldPrefix marks file parts that are always treated as resources.
+// This allows uploading resources with the name of another field like input.
+const resourceFieldPrefix = "resource:"
+
+// bindMultipartConvertRequest reads the multipart form part by part. Every
+// part is read into memory exactly once, the form is not buffered in memory
+// or temporary files beforehand.
+func bindMultipartConvertRequest(r *http.Request) (convertRequest, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return convertRequest{}, fmt.Errorf("could not parse multipart form: %w", err)
+	}
+
+	d := convertRequest{
+		Resources: make(map[string][]byte),
+	}
+	values := make(map[string][]string)
+	files := make(map[string]bool)
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return convertRequest{}, fmt.Errorf("could not parse multipart form: %w", err)
+		}
+		fieldName := part.FormName()
+		content, err := io.ReadAll(part)
+		part.Close()
+		if err != nil {
+			return convertRequest{}, fmt.Errorf("could not read field %q: %w", fieldName, err)
+		}
+		if fieldName == "" {
+			continue
+		}
+		if part.FileName() == "" {
+			values[fieldName] = append(values[fieldName], string(content))
+			continue
+		}
+
+		if files[fieldName] {
+			return convertRequest{}, fmt.Errorf("expected exactly one file for field %q", fieldName)
+		}
+		files[fieldName] = true
+
+		// every file part besides the input and the defaults is treated as a
+		// resource, the field name is used as the relative path inside the
+		// working directory
+		switch fieldName {
+		case "input":
+			d.Input = content
+		case "defaults":
+			d.Defaults = string(content)
+		default:
+			resourceName := strings.TrimPrefix(fieldName, resourceFieldPrefix)
+			if _, ok := d.Resources[resourceName]; ok {
+				return convertRequest{}, fmt.Errorf("expected exactly one file for resource %q", resourceName)
+			}
+			d.Resources[resourceName] = content
+		}
+	}
+
+	value := func(name string) string {
+		if v := values[name]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+
+	d.InputFormat = value("input_format")
+	d.Template = value("template")
+	d.OutputFormat = value("output_format")
+	d.CallbackURL = value("callback_url")
+	d.Profile = value("profile")
+	d.PDFEngine = value("pdf_engine")
+	d.CSL = value("csl")
+	// the options can be sent multiple times
+	d.PDFEngineOpts = values["pdf_engine_opts"]
+	d.Bibliography = values["bibliography"]
+	d.Filters = values["filters"]
+
+	// the input and the defaults can either be supplied as a file or as a
+	// plain form value
+	if !files["input"] {
+		if v := value("input"); v != "" {
+			d.Input = []byte(v)
+		}
+	}
+	if !files["defaults"] {
+		d.Defaults = value("defaults")
+	}
+
+	if v := value("citeproc"); v != "" {
+		citeproc, err := strconv.ParseBool(v)
+		if err != nil {
+			return convertRequest{}, fmt.Errorf("could not parse citeproc: %w", err)
+		}
+		d.Citeproc = citeproc
+	}
+
+	// metadata is a nested object so it's sent as JSON encoded form value
+	if v := value("metadata"); v != "" {
+		if err := json.Unmarshal([]byte(v), &d.Metadata); err != nil {
+			return convertRequest{}, fmt.Errorf("could not parse metadata: %w", err)
+		}
+	}
+
+	return d, nil
+}
+
+func readMultipartFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open uploaded file %q: %w", fh.Filename, err)
+	}
+	defer f.Close()
+	content, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("could not read uploaded file %q: %w", fh.Filename, err)
+	}
+	return content, nil
+}
+
+// newConversion validates the request parameters. The returned error can be
+// sent to the client.
+func (app *application) newConversion(d convertRequest) (conversion, error) {
+	input, err := getInputFormat(d.InputFormat, app.config.AllowedInputFormats)
+	if err != nil {
+		return conversion{}, newEchoJsonError(err, http.StatusBadRequest, err.Error())
+	}
+
+	format, err := getOutputFormat(d.OutputFormat)
+	if err != nil {
+		return conversion{}, newEchoJsonError(err, http.StatusBadRequest, err.Error())
+	}
+
+	var prof profile
+	if d.Profile != "" {
+		var ok bool
+		prof, ok = app.profiles[d.Profile]
+		if !ok {
+			return conversion{}, newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("unknown profile %q, available profiles: %s", d.Profile, strings.Join(profileNames(app.profiles), ", ")))
+		}
+	}
+
+	defaults, err := parseDefaults([]byte(d.Defaults))
+	if err != nil {
+		if errors.Is(err, errInvalidDefaults) {
+			return conversion{}, newEchoJsonError(err, http.StatusBadRequest, err.Error())
+		}
+		return conversion{}, err
+	}
+
+	// values from the request override the profile
+	template := d.Template
+	if template == "" {
+		template = prof.template
+	}
+	var metadata map[string]any
+	if len(prof.metadata) > 0 || len(d.Metadata) > 0 {
+		metadata = make(map[string]any, len(prof.metadata)+len(d.Metadata))
+		maps.Copy(metadata, prof.metadata)
+		maps.Copy(metadata, d.Metadata)
+	}
+
+	// pdfs are always rendered through a template, all other formats
+	// fall back to the pandoc default template if none is supplied
+	if d.Input == nil || (template == "" && format.extension == "pdf") {
+		return conversion{}, newEchoJsonError(nil, http.StatusBadRequest, "invalid input")
+	}
+
+	pdfEngine, err := app.pdfEngine(d, prof, template, format)
+	if err != nil {
+		return conversion{}, newEchoJsonError(err, http.StatusBadRequest, err.Error())
+	}
+	if err := validatePDFEngineOpts(pdfEngine, d.PDFEngineOpts, app.config.PDFEngines.Options); err != nil {
+		return conversion{}, newEchoJsonError(err, http.StatusBadRequest, err.Error())
+	}
+
+	conv := conversion{
+		input:         d.Input,
+		inputFormat:   input,
+		template:      template,
+		outputFormat:  format,
+		metadata:      metadata,
+		args:          prof.args,
+		defaults:      defaults,
+		pdfEngine:     pdfEngine,
+		pdfEngineOpts: d.PDFEngineOpts,
+	}
+
+	// uploaded templates take precedence over the builtin ones
+	var assets map[string][]byte
+	if template != "" {
+		tmpl, err := app.templates.get(template)
+		switch {
+		case err == nil:
+			conv.templateContent = tmpl.content
+			conv.templateFormat = tmpl.info.Format
+			assets = tmpl.assets
+		case errors.Is(err, errTemplateNotFound), errors.Is(err, errInvalidTemplateName):
+			// not an uploaded template, so it needs to be a builtin or an explicitly allowed one
+			if err := app.checkTemplateAllowed(template); err != nil {
+				return conversion{}, err
+			}
+			extensions := []string{format.writer, format.extension}
+			if format.extension == "pdf" {
+				extensions = []string{pdfWriter(pdfEngine)}
+			}
+			conv.templateFile, err = app.templates.builtinPath(template, extensions...)
+			switch {
+			case errors.Is(err, errTemplateNotFound) && !slices.Contains(app.config.AllowedTemplates, template):
+				// the builtin template exists for other formats only
+				return conversion{}, newEchoJsonError(err, http.StatusBadRequest, fmt.Sprintf("template %q is not available for the %s writer", template, extensions[0]))
+			case err != nil && !errors.Is(err, errTemplateNotFound) && !errors.Is(err, errInvalidTemplateName):
+				return conversion{}, err
+			}
+		default:
+			return conversion{}, err
+		}
+	}
+
+	// resources supplied in the request override the profile resources
+	// which override the template assets
+	conv.resources = d.Resources
+	if len(assets) > 0 || len(prof.resources) > 0 {
+		resources := make(map[string][]byte, len(assets)+len(prof.resources)+len(d.Resources))
+		maps.Copy(resources, assets)
+		maps.Copy(resources, prof.resources)
+		maps.Copy(resources, d.Resources)
+		conv.resources = resources
+	}
+
+	// pandoc looks for templates in the working directory first, so a
+	// resource could replace a template pandoc resolves on its own
+	if conv.template != "" && conv.templateContent == nil && conv.templateFile == "" {
+		for name := range conv.resources {
+			cleaned := path.Clean(name)
+			if path.Dir(cleaned) == "." && strings.TrimSuffix(cleaned, path.Ext(cleaned)) == conv.template {
+				return conversion{}, newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("resource %q conflicts with template %q", name, conv.template))
+			}
+		}
+	}
+
+	if err := app.addCitations(&conv, d); err != nil {
+		return conversion{}, err
+	}
+
+	conv.luaFilters, err = app.luaFilters.resolve(d.Filters)
+	if errors.Is(err, errUnknownLuaFilter) {
+		return conversion{}, app.unknownLuaFilterError(err)
+	}
+	if err != nil {
+		return conversion{}, err
+	}
+
+	return conv, nil
+}
+
+func (app *application) unknownLuaFilterError(err error) error {
+	available, listErr := app.luaFilters.list()
+	if listErr != nil {
+		return listErr
+	}
+	return newEchoJsonError(err, http.StatusBadRequest, fmt.Sprintf("%s, available filters: %s", err.Error(), strings.Join(available, ", ")))
+}
+
+func (app *application) unknownStyleError(name string) error {
+	styles, err := app.styles.list()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(styles))
+	for _, style := range styles {
+		names = append(names, style.Name)
+	}
+	return newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("unknown style %q, send it as resource or use one of the available styles: %s", name, strings.Join(names, ", ")))
+}
+
+// bibliographyExtensions are the supported bibliography formats
+var bibliographyExtensions = []string{".bib", ".bibtex", ".biblatex", ".json", ".yaml", ".yml"}
+
+// addCitations validates the bibliography files and the CSL style of the
+// request. Bibliographies need to be sent as resources, styles can either be
+// a resource or the name of a style from the style library.
+func (app *application) addCitations(conv *conversion, d convertRequest) error {
+	for _, bibliography := range d.Bibliography {
+		if !slices.Contains(bibliographyExtensions, strings.ToLower(filepath.Ext(bibliography))) {
+			return newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("unsupported bibliography format %q, supported extensions: %s", bibliography, strings.Join(bibliographyExtensions, ", ")))
+		}
+		if _, ok := conv.resources[bibliography]; !ok || !filepath.IsLocal(bibliography) {
+			return newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("bibliography %q is not part of the resources", bibliography))
+		}
+	}
+	conv.bibliography = d.Bibliography
+
+	if d.CSL != "" {
+		if _, ok := conv.resources[d.CSL]; ok && filepath.IsLocal(d.CSL) {
+			conv.csl = d.CSL
+		} else {
+			content, err := app.styles.get(d.CSL)
+			if errors.Is(err, errStyleNotFound) || errors.Is(err, errInvalidStyleName) {
+				return app.unknownStyleError(d.CSL)
+			}
+			if err != nil {
+				return err
+			}
+			// styles from the library are placed in their own directory so they
+			// don't clash with the resources of the request
+			conv.csl = filepath.ToSlash(filepath.Join("csl", d.CSL+cslExtension))
+			resources := maps.Clone(conv.resources)
+			if resources == nil {
+				resources = make(map[string][]byte, 1)
+			}
+			resources[conv.csl] = content
+			conv.resources = resources
+		}
+	}
+
+	conv.citeproc = d.Citeproc || len(conv.bibliography) > 0 || conv.csl != ""
+	return nil
+}
+
+// pdfEngine returns the pdf engine for the conversion. The engine from the
+// request takes precedence over the one of the profile, the template and the
+// configured default.
+func (app *application) pdfEngine(d convertRequest, prof profile, template string, format outputFormat) (string, error) {
+	if format.extension != "pdf" {
+		if d.PDFEngine != "" || len(d.PDFEngineOpts) > 0 {
+			return "", errors.New("pdf_engine and pdf_engine_opts can only be used for pdf output")
+		}
+		return "", nil
+	}
+
+	if d.PDFEngine != "" {
+		return getPDFEngine(d.PDFEngine, app.config.PDFEngines.Allowed)
+	}
+	// the engines from the config are validated on startup
+	if prof.pdfEngine != "" {
+		return prof.pdfEngine, nil
+	}
+	if engine, ok := app.config.PDFEngines.Templates[template]; ok {
+		return engine, nil
+	}
+	return app.config.PDFEngines.Default, nil
+}
+
+// checkTemplateAllowed makes sure the template is either a builtin template
+// from the pandoc data dir or listed in the allowed templates. This prevents
+// loading arbitrary files as templates.
+func (app *application) checkTemplateAllowed(name string) error {
+	if slices.Contains(app.config.AllowedTemplates, name) {
+		return nil
+	}
+	exists, err := app.templates.builtinExists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	available, err := app.availableTemplates()
+	if err != nil {
+		return err
+	}
+	return newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("unknown template %q, available templates: %s", name, strings.Join(available, ", ")))
+}
+
+// availableTemplates returns the names of all templates that can be used
+func (app *application) availableTemplates() ([]string, error) {
+	templates, err := app.templates.list()
+	if err != nil {
+		return nil, err
+	}
+	names := slices.Clone(app.config.AllowedTemplates)
+	for _, t := range templates {
+		names = append(names, t.Name)
+	}
+	slices.Sort(names)
+	return slices.Compact(names), nil
+}
+
+func (app *application) handleStatus(c *echo.Context) error {
+	type jsonResponse struct {
+		Workers       int `json:"workers"`
+		ActiveWorkers int `json:"active_workers"`
+		QueueSize     int `json:"queue_size"`
+		QueueDepth    int `json:"queue_depth"`
+	}
+
+	return c.JSON(http.StatusOK, jsonResponse{
+		Workers:       app.pool.workers(),
+		ActiveWorkers: app.pool.active(),
+		QueueSize:     app.config.Workers.QueueSize,
+		QueueDepth:    app.pool.queueDepth(),
+	})
+}
+
+func (app *application) handleConvert(c *echo.Context) error {
+	ctx := c.Request().Context()
+
+	_, span := tracer.Start(ctx, "bind request")
+	d, err := app.bindConvertRequest(c)
+	endSpan(span, err)
+	if err != nil {
+		return bindError(err)
+	}
+
+	if d.CallbackURL != "" {
+		return newEchoJsonError(nil, http.StatusBadRequest, "callback_url is only supported for jobs")
+	}
+
+	_, span = tracer.Start(ctx, "validate request")
+	conv, err := app.newConversion(d)
+	if err == nil {
+		err = app.authorizeConversion(c, d, conv)
+	}
+	endSpan(span, err)
+	if err != nil {
+		return err
+	}
+
+	result, cacheStatus, err := app.cache.do(ctx, conv, func(ctx context.Context) (conversionResult, error) {
+		_, span := tracer.Start(ctx, "wait for worker")
+		release, err := app.pool.acquire(ctx, app.config.Workers.MaxWait)
+		endSpan(span, err)
+		if err != nil {
+			return conversionResult{}, err
+		}
+		defer release()
+		return app.converter.convert(ctx, conv)
+	})
+	if cacheStatus != "" {
+		c.Set(contextKeyCacheStatus, cacheStatus)
+		trace.SpanFromContext(ctx).SetAttributes(attribute.String("pandoc.cache_status", cacheStatus))
+	}
+	if err != nil {
+		return app.conversionError(c, err)
+	}
+
+	_, span = tracer.Start(ctx, "send response")
+	err = app.sendConversionResult(c, conv, result)
+	endSpan(span, err)
+	return err
+}
+
+// conversionError converts an error returned by a conversion into an error
+// that can be sent to the client
+func (app *application) conversionError(c *echo.Context, err error) error {
+	ctx := c.Request().Context()
+	var limitErr *resourceLimitError
+	var jsonErr *echoJsonError
+	switch {
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		app.logger.DebugContext(ctx, "no free worker",
+			slog.Int("active_workers", app.pool.active()),
+			slog.Int("queue_depth", app.pool.queueDepth()),
+			slog.String("err", err.Error()))
+		app.setRetryAfter(c)
+		return newEchoJsonError(err, http.StatusServiceUnavailable, "server is busy, please try again later")
+	case errors.Is(err, errJobStorageFull):
+		return newEchoJsonErrorWithCode(err, http.StatusServiceUnavailable, jobErrorStorageFull, err.Error())
+	case errors.As(err, &limitErr):
+		app.logger.ErrorContext(ctx, "error on convert", slog.String("error", err.Error()))
+		jsonErr = newEchoJsonErrorWithCode(err, http.StatusUnprocessableEntity, limitErr.limit, "conversion exceeded a resource limit")
+	default:
+		app.logger.ErrorContext(ctx, "error on convert", slog.String("error", err.Error()))
+		jsonErr = newEchoJsonError(err, http.StatusBadRequest, "error converting document")
+	}
+
+	var diagErr *diagnosticsError
+	if errors.As(err, &diagErr) {
+		jsonErr.diagnostics = app.visibleDiagnostics(diagErr.diagnostics)
+	}
+	return jsonErr
+}
+
+// visibleDiagnostics returns nil if diagnostics should not be sent to clients
+func (app *application) visibleDiagnostics(diagnostics []diagnostic) []diagnostic {
+	if app.config.HideDiagnostics {
+		return nil
+	}
+	return diagnostics
+}
+
+func (app *application) setRetryAfter(c *echo.Context) {
+	seconds := max(int(math.Ceil(app.config.Workers.MaxWait.Seconds())), 1)
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(seconds))
+}
+
+// sendConversionResult sends the converted document either as JSON or as raw
+// bytes, depending on what the client requested
+func (app *application) sendConversionResult(c *echo.Context, conv conversion, result conversionResult) error {
+	type jsonResponse struct {
+		Content     []byte       `json:"content"`
+		ContentType string       `json:"content_type"`
+		Extension   string       `json:"extension"`
+		Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+	}
+
+	bin := result.content
+
+	format := conv.outputFormat
+	if wantsRawResponse(c, format) {
+		filename := filenameFromTitle(documentTitle(conv.input), format.extension)
+		c.Response().Header().Set(echo.HeaderContentDisposition, mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+		c.Response().Header().Set(echo.HeaderContentLength, strconv.Itoa(len(bin)))
+		return c.Blob(http.StatusOK, format.contentType, bin)
+	}
+
+	return c.JSON(http.StatusOK, jsonResponse{
+		Content:     bin,
+		ContentType: format.contentType,
+		Extension:   format.extension,
+		Diagnostics: app.visibleDiagnostics(result.diagnostics),
+	})
+}
+
+func (app *application) handleJobCreate(c *echo.Context) error {
+	d, err := app.bindConvertRequest(c)
+	if err != nil {
+		return bindError(err)
+	}
+
+	conv, err := app.newConversion(d)
+	if err != nil {
+		return err
+	}
+
+	if err := app.authorizeConversion(c, d, conv); err != nil {
+		return err
+	}
+
+	if d.CallbackURL != "" {
+		if err := app.jobs.webhook.validateURL(d.CallbackURL); err != nil {
+			return newEchoJsonError(err, http.StatusBadRequest, err.Error())
+		}
+	}
+
+	j, err := app.jobs.submit(requestIDFromContext(c.Request().Context()), principalID(c), conv, d.CallbackURL)
+	switch {
+	case errors.Is(err, errQueueFull):
+		metricQueueRejections.WithLabelValues("full").Inc()
+		app.setRetryAfter(c)
+		return newEchoJsonError(err, http.StatusServiceUnavailable, "job queue is full, please try again later")
+	case err != nil:
+		return newEchoJsonError(err, http.StatusServiceUnavailable, "too many jobs, please try again later")
+	}
+	return c.JSON(http.StatusAccepted, j.status(app.config.Jobs.Retention))
+}
+
+// getJob returns the job of the request. Jobs of other clients are reported as
+// not found so their ids can not be probed.
+func (app *application) getJob(c *echo.Context) (*job, error) {
+	j, ok := app.jobs.get(c.Param("id"))
+	if !ok || !canAccessJob(c, j) {
+		return nil, newEchoJsonError(nil, http.StatusNotFound, "job not found")
+	}
+	return j, nil
+}
+
+func (app *application) handleJobStatus(c *echo.Context) error {
+	j, err := app.getJob(c)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, j.status(app.config.Jobs.Retention))
+}
+
+func (app *application) handleJobResult(c *echo.Context) error {
+	j, err := app.getJob(c)
+	if err != nil {
+		return err
+	}
+
+	state, result := j.finishedState()
+	switch state {
+	case jobStateDone:
+		return app.sendConversionResult(c, j.conversion, result)
+	case jobStateFailed:
+		return app.conversionError(c, j.failure())
+	default:
+		return newEchoJsonError(nil, http.StatusConflict, fmt.Sprintf("job is %s", state))
+	}
+}
+
+func (app *application) handleJobDelete(c *echo.Context) error {
+	j, err := app.getJob(c)
+	if err != nil {
+		return err
+	}
+	if !app.jobs.cancel(j.id) {
+		return newEchoJsonError(nil, http.StatusNotFound, "job not found")
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (app *application) handleTemplateList(c *echo.Context) error {
+	templates, err := app.templates.list()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, templates)
+}
+
+func (app *application) handleTemplateGet(c *echo.Context) error {
+	type jsonResponse struct {
+		templateInfo
+		Content []byte `json:"content"`
+	}
+
+	name := c.Param("name")
+	tmpl, err := app.templates.get(name)
+	if errors.Is(err, errTemplateNotFound) {
+		tmpl, err = app.templates.getBuiltin(name)
+	}
+	if err != nil {
+		return templateError(err)
+	}
+	return c.JSON(http.StatusOK, jsonResponse{
+		templateInfo: tmpl.info,
+		Content:      tmpl.content,
+	})
+}
+
+func (app *application) handleTemplateUpload(c *echo.Context) error {
+	if !app.templates.writable() {
+		return newEchoJsonError(nil, http.StatusNotImplemented, "template uploads are not configured on this server")
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		return newEchoJsonError(err, http.StatusBadRequest, "invalid input")
+	}
+
+	var content []byte
+	format := c.FormValue("format")
+	assets := make(map[string][]byte)
+	// every file part besides the template is treated as an asset, the field
+	// name is used as the relative path of the asset
+	for fieldName, files := range form.File {
+		if len(files) != 1 {
+			return newEchoJsonError(nil, http.StatusBadRequest, fmt.Sprintf("expected exactly one file for field %q", fieldName))
+		}
+		fileContent, err := readMultipartFile(files[0])
+		if err != nil {
+			return newEchoJsonError(err, http.StatusBadRequest, "invalid input")
+		}
+		if fieldName == "template" {
+			content = fileContent
+			if format == "" {
+				format = strings.TrimPrefix(filepath.Ext(files[0].Filename), ".")
+			}
+			continue
+		}
+		assets[fieldName] = fileContent
+	}
+
+	if content == nil {
+		return newEchoJsonError(nil, http.StatusBadRequest, "missing template file")
+	}
+
+	info, err := app.templates.save(c.Param("name"), strings.ToLower(format), c.FormValue("description"), content, assets)
+	if err != nil {
+		return templateError(err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+func (app *application) handleTemplateDelete(c *echo.Context) error {
+	if err := app.templates.delete(c.Param("name")); err != nil {
+		return templateError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// templateError converts errors returned by the template store into errors
+// that can be sent to the client
+func templateError(err error) error {
+	switch {
+	case errors.Is(err, errTemplateNotFound):
+		return newEchoJsonError(err, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidTemplateName):
+		return newEchoJsonError(err, http.StatusBadRequest, err.Error())
+	case errors.Is(err, errInvalidTemplate):
+		return newEchoJsonError(err, http.StatusBadRequest, "invalid template format or asset path")
+	default:
+		return err
+	}
+}
+
+func (app *application) handleStyleList(c *echo.Context) error {
+	styles, err := app.styles.list()
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, styles)
+}
+
+func (app *application) handleStyleGet(c *echo.Context) error {
+	content, err := app.styles.get(c.Param("name"))
+	if err != nil {
+		return styleError(err)
+	}
+	return c.Blob(http.StatusOK, "application/vnd.citationstyles.style+xml", content)
+}
+
+func (app *application) handleStyleUpload(c *echo.Context) error {
+	if !app.styles.enabled() {
+		return newEchoJsonError(nil, http.StatusNotImplemented, "style uploads are not configured on this server")
+	}
+
+	fh, err := c.FormFile("style")
+	if err != nil {
+		return newEchoJsonError(err, http.StatusBadRequest, "missing style file")
+	}
+	content, err := readMultipartFile(fh)
+	if err != nil {
+		return newEchoJsonError(err, http.StatusBadRequest, "invalid input")
+	}
+
+	info, err := app.styles.save(c.Param("name"), content)
+	if err != nil {
+		return styleError(err)
+	}
+	return c.JSON(http.StatusOK, info)
+}
+
+func (app *application) handleStyleDelete(c *echo.Context) error {
+	if err := app.styles.delete(c.Param("name")); err != nil {
+		return styleError(err)
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// styleError converts errors returned by the style store into errors that
+// can be sent to the client
+func styleError(err error) error {
+	switch {
+	case errors.Is(err, errStyleNotFound):
+		return newEchoJsonError(err, http.StatusNotFound, err.Error())
+	case errors.Is(err, errInvalidStyleName), errors.Is(err, errInvalidStyle):
+		return newEchoJsonError(err, http.StatusBadRequest, err.Error())
+	default:
+		return err
+	}
+}
+
+// wantsRawResponse checks if the client requested the raw document instead
+// of the default JSON response. This can either be done by setting the raw
+// query parameter or by sending the content type of the output format (or
+// application/octet-stream) in the Accept header.
+func wantsRawResponse(c *echo.Context, format outputFormat) bool {
+	if raw, err := strconv.ParseBool(c.QueryParam("raw")); err == nil {
+		return raw
+	}
+
+	formatMediaType, _, err := mime.ParseMediaType(format.contentType)
+	if err != nil {
+		return false
+	}
+
+	for accept := range strings.SplitSeq(c.Request().Header.Get(echo.HeaderAccept), ",") {
+		mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+		if mediaType == formatMediaType || mediaType == echo.MIMEOctetStream {
+			return true
+		}
+	}
+	return false
+}
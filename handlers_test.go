@@ -0,0 +1,498 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"github.com/nikoksr/notify"
+)
+
+// writeTestConfig writes a minimal config file and returns its path
+func writeTestConfig(t *testing.T) string {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configFile, []byte(`{"notifications": {"secret_key_header": "SECRET"}}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return configFile
+}
+
+// the sample config is copied by the dev tasks so it needs to stay valid
+func TestSampleConfig(t *testing.T) {
+	configuration, err := config.GetConfig("config_sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAPIKeys(configuration.Auth.APIKeys); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestApplication returns an application using the default config and
+// the converter. modify can change the config before the application is
+// created.
+func newTestApplication(t *testing.T, conv converter, modify func(*config.Configuration)) *application {
+	t.Helper()
+	configuration, err := config.GetConfig(writeTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if modify != nil {
+		modify(&configuration)
+	}
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	app := &application{
+		logger:     logger,
+		config:     configuration,
+		notify:     notify.New(),
+		converter:  conv,
+		pool:       newWorkerPool(configuration.Workers.MaxConcurrent, configuration.Workers.QueueSize),
+		cache:      newConversionCache(configuration.Cache.MaxSize, configuration.Cache.TTL),
+		templates:  newTemplateStore(configuration.TemplatesDir, configuration.PandocDataDir),
+		styles:     newStyleStore(configuration.CSLDir),
+		luaFilters: &luaFilterRegistry{},
+		profiles:   map[string]profile{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	app.jobs = newJobManager(ctx, logger, configuration.Jobs, app.converter, newWebhookSender(configuration.Webhooks, logger), app.pool, app.cache, configuration.HideDiagnostics)
+	return app
+}
+
+// jsonResponse is the JSON response of a successful conversion
+type jsonResponse struct {
+	Content     []byte       `json:"content"`
+	ContentType string       `json:"content_type"`
+	Extension   string       `json:"extension"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+}
+
+// errorResponse is the JSON response of a failed request
+type errorResponse struct {
+	Error       string       `json:"error"`
+	Code        string       `json:"code"`
+	Diagnostics []diagnostic `json:"diagnostics"`
+	RequestID   string       `json:"request_id"`
+}
+
+// setTestAPIKeys configures API keys with the given names and scopes. The
+// token of a key is its name followed by "-token".
+func setTestAPIKeys(t *testing.T, app *application, keys map[string][]string) {
+	t.Helper()
+	configKeys := make([]config.ConfigAPIKey, 0, len(keys))
+	for name, scopes := range keys {
+		hash := sha256.Sum256([]byte(name + "-token"))
+		configKeys = append(configKeys, config.ConfigAPIKey{Name: name, Hash: hex.EncodeToString(hash[:]), Scopes: scopes})
+	}
+	var err error
+	app.apiKeys, err = loadAPIKeys(configKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func doRequest(handler http.Handler, method, path string, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func bearer(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+func postJSON(t *testing.T, handler http.Handler, path string, body any, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	content, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(content))
+	req.Header.Set("Content-Type", "application/json")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeResponse[T any](t *testing.T, rec *httptest.ResponseRecorder) T {
+	t.Helper()
+	var ret T
+	if err := json.Unmarshal(rec.Body.Bytes(), &ret); err != nil {
+		t.Fatalf("could not decode response %q: %v", rec.Body.String(), err)
+	}
+	return ret
+}
+
+func TestConvertJSON(t *testing.T) {
+	fake := &fakeConverter{}
+	app := newTestApplication(t, fake, nil)
+
+	rec := postJSON(t, app.newServer(), "/convert", map[string]any{
+		"input":         []byte("# Hello"),
+		"input_format":  "gfm",
+		"output_format": "html",
+		"metadata":      map[string]any{"title": "Test"},
+		"resources":     map[string][]byte{"images/logo.png": []byte("png")},
+	}, nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get(requestIDHeaderName) == "" {
+		t.Error("response is missing the request id header")
+	}
+
+	resp := decodeResponse[jsonResponse](t, rec)
+	if string(resp.Content) != "# Hello" || resp.Extension != "html" || resp.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected response: %+v", resp)
+	}
+
+	calls := fake.calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected one conversion, got %d", len(calls))
+	}
+	conv := calls[0]
+	if conv.inputFormat.reader != "gfm" || conv.outputFormat.extension != "html" {
+		t.Errorf("unexpected formats: %+v %+v", conv.inputFormat, conv.outputFormat)
+	}
+	if conv.metadata["title"] != "Test" {
+		t.Errorf("unexpected metadata: %v", conv.metadata)
+	}
+	if string(conv.resources["images/logo.png"]) != "png" {
+		t.Errorf("unexpected resources: %v", conv.resources)
+	}
+}
+
+func TestConvertRawResponse(t *testing.T) {
+	app := newTestApplication(t, &fakeConverter{}, nil)
+
+	rec := postJSON(t, app.newServer(), "/convert", map[string]any{
+		"input":         []byte("---\ntitle: My Report\n---\ntext"),
+		"output_format": "html",
+	}, http.Header{"Accept": {"text/html"}})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("Content-Disposition"); got != `attachment; filename=My_Report.html` {
+		t.Errorf("unexpected content disposition %q", got)
+	}
+	if got := rec.Body.String(); got != "---\ntitle: My Report\n---\ntext" {
+		t.Errorf("unexpected body %q", got)
+	}
+}
+
+func TestConvertMultipart(t *testing.T) {
+	fake := &fakeConverter{}
+	app := newTestApplication(t, fake, nil)
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	files := map[string]string{
+		"input": "# Hello",
+		// the prefix allows resources named like a form field
+		"resource:input": "resource named input",
+		"images/a.png":   "png",
+	}
+	for field, content := range files {
+		part, err := w.CreateFormFile(field, "file")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for field, value := range map[string]string{
+		"output_format": "html",
+		"metadata":      `{"title": "Test"}`,
+	} {
+		if err := w.WriteField(field, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/convert", &body)
+	req.Header.Set("Content-Type", w.FormDataContentType())
+	rec := httptest.NewRecorder()
+	app.newServer().ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	calls := fake.calls()
+	if len(calls) != 1 {
+		t.Fatalf("expected one conversion, got %d", len(calls))
+	}
+	conv := calls[0]
+	if string(conv.input) != "# Hello" {
+		t.Errorf("unexpected input %q", conv.input)
+	}
+	if string(conv.resources["input"]) != "resource named input" || string(conv.resources["images/a.png"]) != "png" {
+		t.Errorf("unexpected resources: %v", conv.resources)
+	}
+	if conv.metadata["title"] != "Test" {
+		t.Errorf("unexpected metadata: %v", conv.metadata)
+	}
+}
+
+func TestConvertInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		body map[string]any
+		want string
+	}{
+		{name: "missing input", body: map[string]any{"output_format": "html"}, want: "invalid input"},
+		{name: "invalid output format", body: map[string]any{"input": []byte("x"), "output_format": "exe"}, want: `invalid output format "exe"`},
+		{name: "input format not allowed", body: map[string]any{"input": []byte("x"), "input_format": "odt", "output_format": "html"}, want: `input format "odt" is not allowed`},
+		{name: "pdf without template", body: map[string]any{"input": []byte("x"), "output_format": "pdf"}, want: "invalid input"},
+		{name: "callback url", body: map[string]any{"input": []byte("x"), "output_format": "html", "callback_url": "https://example.com"}, want: "callback_url is only supported for jobs"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeConverter{}
+			app := newTestApplication(t, fake, nil)
+			rec := postJSON(t, app.newServer(), "/convert", tt.body, nil)
+			if rec.Code != http.StatusBadRequest {
+				t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+			}
+			if resp := decodeResponse[errorResponse](t, rec); resp.Error != tt.want || resp.RequestID == "" {
+				t.Errorf("unexpected error response: %+v", resp)
+			}
+			if len(fake.calls()) != 0 {
+				t.Error("invalid request was converted")
+			}
+		})
+	}
+}
+
+func TestConvertError(t *testing.T) {
+	fake := &fakeConverter{err: &diagnosticsError{
+		err:         errors.New("pandoc failed"),
+		diagnostics: []diagnostic{{Level: diagnosticLevelError, Message: "Undefined control sequence.", Source: diagnosticSourceLatex, Line: 42}},
+	}}
+
+	for _, hide := range []bool{false, true} {
+		app := newTestApplication(t, fake, func(c *config.Configuration) {
+			c.HideDiagnostics = hide
+		})
+		rec := postJSON(t, app.newServer(), "/convert", map[string]any{"input": []byte("x"), "output_format": "html"}, nil)
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d: %s", rec.Code, rec.Body.String())
+		}
+		resp := decodeResponse[errorResponse](t, rec)
+		if resp.Error != "error converting document" {
+			t.Errorf("unexpected error %q", resp.Error)
+		}
+		if hide && len(resp.Diagnostics) != 0 {
+			t.Errorf("diagnostics are not hidden: %v", resp.Diagnostics)
+		}
+		if !hide && (len(resp.Diagnostics) != 1 || resp.Diagnostics[0] != fake.err.(*diagnosticsError).diagnostics[0]) {
+			t.Errorf("unexpected diagnostics: %v", resp.Diagnostics)
+		}
+	}
+}
+
+func TestConvertResourceLimitError(t *testing.T) {
+	fake := &fakeConverter{err: &resourceLimitError{limit: limitCPUTime, err: errors.New("killed")}}
+	app := newTestApplication(t, fake, nil)
+
+	rec := postJSON(t, app.newServer(), "/convert", map[string]any{"input": []byte("x"), "output_format": "html"}, nil)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected status 422, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeResponse[errorResponse](t, rec); resp.Code != limitCPUTime {
+		t.Errorf("expected error code %q, got %q", limitCPUTime, resp.Code)
+	}
+}
+
+func TestConvertQueueFull(t *testing.T) {
+	fake := &fakeConverter{block: make(chan struct{})}
+	app := newTestApplication(t, fake, func(c *config.Configuration) {
+		c.Workers.MaxConcurrent = 1
+		c.Workers.QueueSize = 0
+		c.Workers.MaxWait = time.Second
+	})
+	handler := app.newServer()
+
+	// the first request occupies the only worker
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		done <- postJSON(t, handler, "/convert", map[string]any{"input": []byte("first"), "output_format": "html"}, nil)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(fake.calls()) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("first conversion did not start")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	rec := postJSON(t, handler, "/convert", map[string]any{"input": []byte("second"), "output_format": "html"}, nil)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected status 503, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("response is missing the Retry-After header")
+	}
+
+	close(fake.block)
+	if rec := <-done; rec.Code != http.StatusOK {
+		t.Fatalf("expected status 200 for the first request, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestConvertBuiltinTemplateUsesAbsolutePath(t *testing.T) {
+	dataDir := t.TempDir()
+	templatesDir := filepath.Join(dataDir, "templates")
+	if err := os.Mkdir(templatesDir, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"report.latex", "report.html", "memo.html"} {
+		if err := os.WriteFile(filepath.Join(templatesDir, name), []byte("$body$"), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fake := &fakeConverter{}
+	app := newTestApplication(t, fake, func(c *config.Configuration) {
+		c.PandocDataDir = dataDir
+		c.AllowedTemplates = []string{"default"}
+	})
+	handler := app.newServer()
+
+	for format, want := range map[string]string{"pdf": "report.latex", "html": "report.html"} {
+		rec := postJSON(t, handler, "/convert", map[string]any{
+			"input":         []byte("x"),
+			"output_format": format,
+			"template":      "report",
+			// a resource with the name of the template must not replace it
+			"resources": map[string][]byte{"report.latex": []byte("evil"), "report.html": []byte("evil")},
+		}, nil)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: expected status 200, got %d: %s", format, rec.Code, rec.Body.String())
+		}
+		calls := fake.calls()
+		if got := calls[len(calls)-1].templateFile; got != filepath.Join(templatesDir, want) {
+			t.Errorf("%s: expected template file %q, got %q", format, filepath.Join(templatesDir, want), got)
+		}
+	}
+
+	// templates pandoc resolves on its own can not be passed as a path
+	rec := postJSON(t, handler, "/convert", map[string]any{
+		"input":         []byte("x"),
+		"output_format": "html",
+		"template":      "default",
+		"resources":     map[string][]byte{"default.html5": []byte("evil")},
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a resource shadowing a template, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// builtin templates are only used with their own writer
+	calls := len(fake.calls())
+	rec = postJSON(t, handler, "/convert", map[string]any{
+		"input":    []byte("x"),
+		"template": "memo",
+	}, nil)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("expected status 400 for a template of another format, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if resp := decodeResponse[errorResponse](t, rec); resp.Error != `template "memo" is not available for the latex writer` {
+		t.Errorf("unexpected error %q", resp.Error)
+	}
+	if len(fake.calls()) != calls {
+		t.Error("conversion with a template of another format was started")
+	}
+}
+
+func TestConvertPDFEngineOpts(t *testing.T) {
+	fake := &fakeConverter{}
+	app := newTestApplication(t, fake, func(c *config.Configuration) {
+		c.AllowedTemplates = []string{"default"}
+		c.PDFEngines.Options = map[string][]string{"xelatex": {"-interaction=nonstopmode"}}
+	})
+	handler := app.newServer()
+
+	tests := []struct {
+		name   string
+		engine string
+		opts   []string
+		status int
+	}{
+		{name: "allowed option", engine: "xelatex", opts: []string{"-interaction=nonstopmode"}, status: http.StatusOK},
+		{name: "option not allowed", engine: "xelatex", opts: []string{"-shell-escape"}, status: http.StatusBadRequest},
+		{name: "different value", engine: "xelatex", opts: []string{"-interaction=batchmode"}, status: http.StatusBadRequest},
+		{name: "option of another engine", engine: "lualatex", opts: []string{"-interaction=nonstopmode"}, status: http.StatusBadRequest},
+		{name: "default engine", opts: []string{"-interaction=nonstopmode"}, status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(t, handler, "/convert", map[string]any{
+				"input":           []byte("x"),
+				"template":        "default",
+				"pdf_engine":      tt.engine,
+				"pdf_engine_opts": tt.opts,
+			}, nil)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+	if calls := fake.calls(); len(calls) != 1 || calls[0].pdfEngine != "xelatex" {
+		t.Fatalf("expected one xelatex conversion, got %+v", calls)
+	}
+}
+
+func TestTemplateRoutesScopes(t *testing.T) {
+	app := newTestApplication(t, &fakeConverter{}, nil)
+	setTestAPIKeys(t, app, map[string][]string{
+		"client": {scopeConvert},
+		"editor": {scopeTemplatesWrite},
+	})
+	handler := app.newServer()
+
+	tests := []struct {
+		method string
+		path   string
+		token  string
+		status int
+	}{
+		{method: http.MethodGet, path: "/templates", token: "client-token", status: http.StatusOK},
+		{method: http.MethodGet, path: "/styles", token: "client-token", status: http.StatusOK},
+		{method: http.MethodDelete, path: "/templates/report", token: "client-token", status: http.StatusForbidden},
+		{method: http.MethodDelete, path: "/styles/apa", token: "client-token", status: http.StatusForbidden},
+		{method: http.MethodGet, path: "/templates", token: "editor-token", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path+" "+tt.token, func(t *testing.T) {
+			rec := doRequest(handler, tt.method, tt.path, bearer(tt.token))
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
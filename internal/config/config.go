@@ -2,6 +2,8 @@
 
 import (
 	"fmt"
+	"runtime"
+	"slices"
 	"strings"
 	"time"
 
@@ -13,23 +15,157 @@
 )
 
 type Configuration struct {
-	Server         ConfigServer       `koanf:"server"`
-	Notifications  ConfigNotification `koanf:"notifications"`
-	Timeout        time.Duration      `koanf:"timeout"`
-	Cloudflare     bool               `koanf:"cloudflare"`
-	PandocPath     string             `koanf:"pandoc_path"`
-	PandocDataDir  string             `koanf:"pandoc_data_dir"`
-	CommandTimeout time.Duration      `koanf:"command_timeout"`
+	Server                 ConfigServer             `koanf:"server"`
+	Notifications          ConfigNotification       `koanf:"notifications"`
+	Timeout                time.Duration            `koanf:"timeout"`
+	Cloudflare             bool                     `koanf:"cloudflare"`
+	PandocPath             string                   `koanf:"pandoc_path"`
+	PandocDataDir          string                   `koanf:"pandoc_data_dir"`
+	CommandTimeout         time.Duration            `koanf:"command_timeout"`
+	CommandKillGracePeriod time.Duration            `koanf:"command_kill_grace_period"`
+	AllowedInputFormats    []string                 `koanf:"allowed_input_formats"`
+	Jobs                   ConfigJobs               `koanf:"jobs"`
+	Webhooks               ConfigWebhooks           `koanf:"webhooks"`
+	Workers                ConfigWorkers            `koanf:"workers"`
+	Limits                 ConfigLimits             `koanf:"limits"`
+	PandocServer           ConfigPandocServer       `koanf:"pandoc_server"`
+	Cache                  ConfigCache              `koanf:"cache"`
+	TemplatesDir           string                   `koanf:"templates_dir"`
+	AllowedTemplates       []string                 `koanf:"allowed_templates"`
+	Profiles               map[string]ConfigProfile `koanf:"profiles"`
+	PDFEngines             ConfigPDFEngines         `koanf:"pdf_engines"`
+	CSLDir                 string                   `koanf:"csl_dir"`
+	LuaFiltersDir          string                   `koanf:"lua_filters_dir"`
+	HideDiagnostics        bool                     `koanf:"hide_diagnostics"`
+	Tracing                ConfigTracing            `koanf:"tracing"`
+	Auth                   ConfigAuth               `koanf:"auth"`
 }
 
 type ConfigServer struct {
 	Listen          string        `koanf:"listen"`
 	PprofListen     string        `koanf:"listen_pprof"`
+	MetricsListen   string        `koanf:"listen_metrics"`
 	GracefulTimeout time.Duration `koanf:"graceful_timeout"`
 	RootCA          string        `koanf:"root_ca"`
 	CertSubject     string        `koanf:"cert_subject"`
 }
 
+type ConfigPandocServer struct {
+	URL                 string        `koanf:"url"`
+	HealthCheckInterval time.Duration `koanf:"health_check_interval"`
+}
+
+// ConfigProfile is a named set of defaults for conversions
+type ConfigProfile struct {
+	Template  string                  `koanf:"template"`
+	PDFEngine string                  `koanf:"pdf_engine"`
+	Metadata  map[string]any          `koanf:"metadata"`
+	Args      []string                `koanf:"args"`
+	Resources []ConfigProfileResource `koanf:"resources"`
+}
+
+// ConfigPDFEngines lists the installed pdf engines clients can choose from.
+// Templates maps template names to the engine used if the request does not
+// specify one, Default is used for all other templates. An empty Default
+// uses the pandoc default engine. Options maps engines to the options
+// clients can pass to them, all other options are rejected.
+type ConfigPDFEngines struct {
+	Allowed   []string            `koanf:"allowed"`
+	Default   string              `koanf:"default"`
+	Templates map[string]string   `koanf:"templates"`
+	Options   map[string][]string `koanf:"options"`
+}
+
+// ConfigProfileResource is a file on the server that is placed at Name
+// inside the working directory. This is a list instead of a map as koanf
+// would split file names containing dots into nested keys.
+type ConfigProfileResource struct {
+	Name string `koanf:"name"`
+	Path string `koanf:"path"`
+}
+
+// ConfigAuth configures the authentication of API requests. Authentication
+// is disabled if no API keys are configured and JWT validation is disabled.
+type ConfigAuth struct {
+	APIKeys []ConfigAPIKey `koanf:"api_keys"`
+	JWT     ConfigJWT      `koanf:"jwt"`
+}
+
+// ConfigAPIKey is a key clients send as a bearer token. Only the hex encoded
+// SHA-256 hash of the key is stored in the config.
+type ConfigAPIKey struct {
+	Name   string   `koanf:"name"`
+	Hash   string   `koanf:"hash"`
+	Scopes []string `koanf:"scopes"`
+}
+
+// ConfigJWT configures the validation of bearer JWTs. Validation is enabled
+// if either JWKSFile or JWKSURL is set. The keys are reloaded every
+// JWKSRefreshInterval and additionally if a token is signed by an unknown key.
+// The claims named in the *Claim options are mapped to the permissions of
+// the token.
+type ConfigJWT struct {
+	JWKSFile            string        `koanf:"jwks_file"`
+	JWKSURL             string        `koanf:"jwks_url"`
+	JWKSRefreshInterval time.Duration `koanf:"jwks_refresh_interval"`
+	Issuer              string        `koanf:"issuer"`
+	Audience            string        `koanf:"audience"`
+	Algorithms          []string      `koanf:"algorithms"`
+	Leeway              time.Duration `koanf:"leeway"`
+	ScopesClaim         string        `koanf:"scopes_claim"`
+	TemplatesClaim      string        `koanf:"templates_claim"`
+	MaxInputSizeClaim   string        `koanf:"max_input_size_claim"`
+}
+
+// ConfigTracing configures the export of OpenTelemetry traces via OTLP/HTTP.
+// Tracing is disabled if no Endpoint is set. SampleRatio is the fraction of
+// new traces that are recorded, incoming sampling decisions are respected.
+type ConfigTracing struct {
+	Endpoint    string  `koanf:"endpoint"`
+	Insecure    bool    `koanf:"insecure"`
+	ServiceName string  `koanf:"service_name"`
+	SampleRatio float64 `koanf:"sample_ratio"`
+}
+
+// ConfigLimits holds the resource limits for the pandoc process tree.
+// A value of 0 disables the limit.
+type ConfigLimits struct {
+	AddressSpace uint64        `koanf:"address_space"`
+	CPUTime      time.Duration `koanf:"cpu_time"`
+	FileSize     uint64        `koanf:"file_size"`
+	OpenFiles    uint64        `koanf:"open_files"`
+	Processes    uint64        `koanf:"processes"`
+}
+
+// ConfigCache configures the in-memory conversion cache. A MaxSize of 0
+// disables the cache.
+type ConfigCache struct {
+	MaxSize int64         `koanf:"max_size"`
+	TTL     time.Duration `koanf:"ttl"`
+}
+
+type ConfigWorkers struct {
+	MaxConcurrent int           `koanf:"max_concurrent"`
+	QueueSize     int           `koanf:"queue_size"`
+	MaxWait       time.Duration `koanf:"max_wait"`
+}
+
+type ConfigJobs struct {
+	Retention     time.Duration `koanf:"retention"`
+	QueueSize     int           `koanf:"queue_size"`
+	MaxJobs       int           `koanf:"max_jobs"`
+	MaxResultSize int64         `koanf:"max_result_size"`
+}
+
+type ConfigWebhooks struct {
+	Secret               string        `koanf:"secret"`
+	Retries              int           `koanf:"retries"`
+	Backoff              time.Duration `koanf:"backoff"`
+	Timeout              time.Duration `koanf:"timeout"`
+	AllowedHosts         []string      `koanf:"allowed_hosts"`
+	AllowPrivateNetworks bool          `koanf:"allow_private_networks"`
+}
+
 type ConfigNotification struct {
 	SecretKeyHeader string                     `koanf:"secret_key_header"`
 	Telegram        ConfigNotificationTelegram `koanf:"telegram"`
@@ -75,11 +211,65 @@ type ConfigNotificationMSTeams struct {
 		PprofListen:     "127.0.0.1:1234",
 		GracefulTimeout: 10 * time.Second,
 	},
-	CommandTimeout: 1 * time.Minute,
-	PandocPath:     "/usr/local/bin/pandoc",
-	PandocDataDir:  "/.pandoc",
-	Timeout:        5 * time.Second,
-	Cloudflare:     false,
+	CommandTimeout:         1 * time.Minute,
+	CommandKillGracePeriod: 5 * time.Second,
+	PandocPath:             "/usr/local/bin/pandoc",
+	PandocDataDir:          "/.pandoc",
+	Timeout:                5 * time.Second,
+	Cloudflare:             false,
+	AllowedInputFormats: []string{
+		"markdown",
+		"gfm",
+		"commonmark",
+		"commonmark_x",
+		"rst",
+		"org",
+		"asciidoc",
+		"latex",
+		"html",
+		"docx",
+		"ipynb",
+	},
+	PandocServer: ConfigPandocServer{
+		HealthCheckInterval: 30 * time.Second,
+	},
+	Workers: ConfigWorkers{
+		MaxConcurrent: runtime.NumCPU(),
+		QueueSize:     50,
+		MaxWait:       5 * time.Second,
+	},
+	PDFEngines: ConfigPDFEngines{
+		Allowed: []string{"pdflatex", "xelatex", "lualatex"},
+	},
+	Auth: ConfigAuth{
+		JWT: ConfigJWT{
+			JWKSRefreshInterval: 1 * time.Hour,
+			Algorithms:          []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"},
+			Leeway:              30 * time.Second,
+			ScopesClaim:         "scope",
+			TemplatesClaim:      "pandoc_templates",
+			MaxInputSizeClaim:   "pandoc_max_input_size",
+		},
+	},
+	Tracing: ConfigTracing{
+		ServiceName: "pandocserver",
+		SampleRatio: 1,
+	},
+	Cache: ConfigCache{
+		MaxSize: 0,
+		TTL:     5 * time.Minute,
+	},
+	Jobs: ConfigJobs{
+		Retention:     1 * time.Hour,
+		QueueSize:     50,
+		MaxJobs:       1000,
+		MaxResultSize: 1 << 30,
+	},
+	Webhooks: ConfigWebhooks{
+		Retries: 5,
+		Backoff: 1 * time.Second,
+		Timeout: 10 * time.Second,
+	},
 }
 
 func GetConfig(f string) (Configuration, error) {
@@ -120,5 +310,56 @@ func GetConfig(f string) (Configuration, error) {
 		return Configuration{}, fmt.Errorf("please supply a secret key header in the config")
 	}
 
+	if config.Workers.MaxConcurrent < 1 {
+		return Configuration{}, fmt.Errorf("workers.max_concurrent must be at least 1")
+	}
+
+	if config.Workers.QueueSize < 0 {
+		return Configuration{}, fmt.Errorf("workers.queue_size must not be negative")
+	}
+
+	if config.Jobs.QueueSize < 1 {
+		return Configuration{}, fmt.Errorf("jobs.queue_size must be at least 1")
+	}
+
+	if config.Jobs.MaxJobs < 0 || config.Jobs.MaxResultSize < 0 {
+		return Configuration{}, fmt.Errorf("jobs.max_jobs and jobs.max_result_size must not be negative")
+	}
+
+	if jwt := config.Auth.JWT; jwt.JWKSFile != "" || jwt.JWKSURL != "" {
+		if jwt.JWKSFile != "" && jwt.JWKSURL != "" {
+			return Configuration{}, fmt.Errorf("only one of auth.jwt.jwks_file and auth.jwt.jwks_url can be set")
+		}
+		if jwt.Issuer == "" || jwt.Audience == "" {
+			return Configuration{}, fmt.Errorf("auth.jwt.issuer and auth.jwt.audience are required to validate JWTs")
+		}
+		if jwt.JWKSRefreshInterval <= 0 {
+			return Configuration{}, fmt.Errorf("auth.jwt.jwks_refresh_interval must be positive")
+		}
+	}
+
+	if config.Tracing.SampleRatio < 0 || config.Tracing.SampleRatio > 1 {
+		return Configuration{}, fmt.Errorf("tracing.sample_ratio must be between 0 and 1")
+	}
+
+	if config.PDFEngines.Default != "" && !slices.Contains(config.PDFEngines.Allowed, config.PDFEngines.Default) {
+		return Configuration{}, fmt.Errorf("pdf_engines.default %q is not in pdf_engines.allowed", config.PDFEngines.Default)
+	}
+	for template, engine := range config.PDFEngines.Templates {
+		if !slices.Contains(config.PDFEngines.Allowed, engine) {
+			return Configuration{}, fmt.Errorf("pdf engine %q of template %q is not in pdf_engines.allowed", engine, template)
+		}
+	}
+	for engine := range config.PDFEngines.Options {
+		if !slices.Contains(config.PDFEngines.Allowed, engine) {
+			return Configuration{}, fmt.Errorf("pdf engine %q in pdf_engines.options is not in pdf_engines.allowed", engine)
+		}
+	}
+	for name, profile := range config.Profiles {
+		if profile.PDFEngine != "" && !slices.Contains(config.PDFEngines.Allowed, profile.PDFEngine) {
+			return Configuration{}, fmt.Errorf("pdf engine %q of profile %q is not in pdf_engines.allowed", profile.PDFEngine, name)
+		}
+	}
+
 	return config, nil
 }
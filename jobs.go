@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+type jobState string
+
+const (
+	jobStateQueued    jobState = "queued"
+	jobStateRunning   jobState = "running"
+	jobStateDone      jobState = "done"
+	jobStateFailed    jobState = "failed"
+	jobStateCancelled jobState = "cancelled"
+)
+
+// jobErrorStorageFull is the error code of jobs failing with errJobStorageFull
+const jobErrorStorageFull = "storage_full"
+
+var (
+	errTooManyJobs    = errors.New("too many jobs")
+	errJobStorageFull = errors.New("job result storage is full")
+)
+
+// job is an asynchronous conversion
+type job struct {
+	id        string
+	requestID string
+	// owner is the id of the principal that created the job, empty if
+	// authentication is disabled
+	owner       string
+	conversion  conversion
+	callbackURL string
+	cancel      context.CancelFunc
+
+	mu       sync.Mutex
+	state    jobState
+	created  time.Time
+	started  time.Time
+	finished time.Time
+	result   conversionResult
+	err      error
+}
+
+// jobStatus is the JSON representation of a job
+type jobStatus struct {
+	ID         string     `json:"id"`
+	State      jobState   `json:"state"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	Error      string     `json:"error,omitempty"`
+	ErrorCode  string     `json:"error_code,omitempty"`
+}
+
+func (j *job) status(retention time.Duration) jobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	s := jobStatus{
+		ID:        j.id,
+		State:     j.state,
+		CreatedAt: j.created,
+	}
+	if !j.started.IsZero() {
+		started := j.started
+		s.StartedAt = &started
+	}
+	if !j.finished.IsZero() {
+		finished := j.finished
+		expires := finished.Add(retention)
+		s.FinishedAt = &finished
+		s.ExpiresAt = &expires
+	}
+	if j.state == jobStateFailed {
+		// the detailed error is only logged
+		s.Error = "error converting document"
+		var limitErr *resourceLimitError
+		switch {
+		case errors.As(j.err, &limitErr):
+			s.ErrorCode = limitErr.limit
+		case errors.Is(j.err, errJobStorageFull):
+			s.Error = errJobStorageFull.Error()
+			s.ErrorCode = jobErrorStorageFull
+		}
+	}
+	return s
+}
+
+// jobCallback is the payload posted to the callback url once a job is finished
+type jobCallback struct {
+	jobStatus
+	Content     []byte       `json:"content,omitempty"`
+	ContentType string       `json:"content_type,omitempty"`
+	Extension   string       `json:"extension,omitempty"`
+	Diagnostics []diagnostic `json:"diagnostics,omitempty"`
+}
+
+// finishedState returns the current state and the result of the job
+func (j *job) finishedState() (jobState, conversionResult) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.state, j.result
+}
+
+// failure returns the error of a failed job
+func (j *job) failure() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.err
+}
+
+func (j *job) setRunning() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.state != jobStateQueued {
+		return false
+	}
+	j.state = jobStateRunning
+	j.started = time.Now()
+	return true
+}
+
+// setFinished stores the result or the error of the job. It returns false if
+// the job was cancelled.
+func (j *job) setFinished(result conversionResult, err error) bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	// a cancelled job stays cancelled
+	if j.state == jobStateCancelled {
+		return false
+	}
+	j.finished = time.Now()
+	if err != nil {
+		j.state = jobStateFailed
+		j.err = err
+		return true
+	}
+	j.state = jobStateDone
+	j.result = result
+	return true
+}
+
+// setCancelled marks a queued or running job as cancelled. It returns false
+// if the job is already finished.
+func (j *job) setCancelled() bool {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	switch j.state {
+	case jobStateDone, jobStateFailed:
+		return false
+	case jobStateCancelled:
+		return true
+	}
+	j.state = jobStateCancelled
+	j.finished = time.Now()
+	return true
+}
+
+// jobManager keeps track of all asynchronous conversions
+type jobManager struct {
+	ctx context.Context
+	// stop cancels all jobs
+	stop      context.CancelFunc
+	logger    *slog.Logger
+	retention time.Duration
+	// queueSize limits the number of queued and running jobs
+	queueSize int
+	// maxJobs limits the number of stored jobs, 0 disables the limit
+	maxJobs int
+	// maxResultSize limits the size of all stored results, 0 disables the
+	// limit
+	maxResultSize int64
+	converter     converter
+	webhook       *webhookSender
+	pool          *workerPool
+	cache         *conversionCache
+	// hideDiagnostics removes the diagnostics from the callbacks
+	hideDiagnostics bool
+
+	mu   sync.Mutex
+	jobs map[string]*job
+	// pending is the number of queued and running jobs
+	pending int
+	// resultSize is the size of all stored results
+	resultSize int64
+	// running tracks the goroutines of all unfinished jobs for the shutdown
+	running sync.WaitGroup
+}
+
+// newJobManager creates a new job manager. All jobs are cancelled when ctx is
+// done or the job manager is shut down.
+func newJobManager(ctx context.Context, logger *slog.Logger, configuration config.ConfigJobs, converter converter, webhook *webhookSender, pool *workerPool, cache *conversionCache, hideDiagnostics bool) *jobManager {
+	ctx, stop := context.WithCancel(ctx)
+	return &jobManager{
+		ctx:             ctx,
+		stop:            stop,
+		logger:          logger,
+		retention:       configuration.Retention,
+		queueSize:       configuration.QueueSize,
+		maxJobs:         configuration.MaxJobs,
+		maxResultSize:   configuration.MaxResultSize,
+		converter:       converter,
+		webhook:         webhook,
+		pool:            pool,
+		cache:           cache,
+		jobs:            make(map[string]*job),
+		hideDiagnostics: hideDiagnostics,
+	}
+}
+
+// submit queues a new conversion and returns the created job. If callbackURL
+// is not empty the result is posted to it once the job is finished. The
+// request id of the request creating the job is added to all job logs and
+// owner is the id of the principal creating it.
+// errQueueFull is returned if the job queue is full and errTooManyJobs if the
+// maximum number of jobs is stored. An accepted job is never rejected later on.
+func (m *jobManager) submit(requestID, owner string, conv conversion, callbackURL string) (*job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.pending >= m.queueSize {
+		return nil, errQueueFull
+	}
+	if m.maxJobs > 0 && len(m.jobs) >= m.maxJobs {
+		return nil, errTooManyJobs
+	}
+
+	ctx, cancel := context.WithCancel(withRequestID(m.ctx, requestID))
+	j := &job{
+		id:          rand.Text(),
+		requestID:   requestID,
+		owner:       owner,
+		conversion:  conv,
+		callbackURL: callbackURL,
+		cancel:      cancel,
+		state:       jobStateQueued,
+		created:     time.Now(),
+	}
+	m.jobs[j.id] = j
+	m.pending++
+
+	m.running.Go(func() {
+		m.run(ctx, j)
+	})
+
+	return j, nil
+}
+
+func (m *jobManager) run(ctx context.Context, j *job) {
+	defer j.cancel()
+
+	result, err := m.runQueued(ctx, j)
+	if err := m.finish(j, result, err); err != nil {
+		m.logger.ErrorContext(ctx, "error on job", slog.String("id", j.id), slog.String("err", err.Error()))
+	}
+
+	if j.callbackURL != "" {
+		m.sendCallback(j)
+	}
+}
+
+// runQueued waits for a free worker and runs the conversion. Jobs stay in
+// the job queue until a worker is available or the job is cancelled.
+func (m *jobManager) runQueued(ctx context.Context, j *job) (conversionResult, error) {
+	// the job is also running if the result is served from the cache or a
+	// concurrent identical conversion
+	if !j.setRunning() {
+		return conversionResult{}, context.Canceled
+	}
+
+	result, cacheStatus, err := m.cache.do(ctx, j.conversion, func(ctx context.Context) (conversionResult, error) {
+		release, err := m.pool.wait(ctx)
+		if err != nil {
+			return conversionResult{}, err
+		}
+		defer release()
+
+		m.logger.DebugContext(ctx, "running job", slog.String("id", j.id))
+		return m.converter.convert(ctx, j.conversion)
+	})
+	if cacheStatus != "" {
+		m.logger.DebugContext(ctx, "job cache status", slog.String("id", j.id), slog.String("cache", cacheStatus))
+	}
+	if err != nil {
+		return conversionResult{}, err
+	}
+	return result, nil
+}
+
+// sendCallback posts the job status and the result to the callback url of the job
+func (m *jobManager) sendCallback(j *job) {
+	state, result := j.finishedState()
+	// the job was cancelled while running, so nobody is waiting for the result
+	if state == jobStateCancelled {
+		return
+	}
+
+	payload := jobCallback{
+		jobStatus: j.status(m.retention),
+	}
+	switch state {
+	case jobStateDone:
+		payload.Content = result.content
+		payload.ContentType = j.conversion.outputFormat.contentType
+		payload.Extension = j.conversion.outputFormat.extension
+		payload.Diagnostics = result.diagnostics
+	case jobStateFailed:
+		var diagErr *diagnosticsError
+		if errors.As(j.failure(), &diagErr) {
+			payload.Diagnostics = diagErr.diagnostics
+		}
+	}
+	if m.hideDiagnostics {
+		payload.Diagnostics = nil
+	}
+
+	// the job context is not used as callbacks are also sent for cancelled jobs
+	ctx := withRequestID(m.ctx, j.requestID)
+	m.logger.DebugContext(ctx, "sending job callback", slog.String("id", j.id), slog.String("url", j.callbackURL))
+	if err := m.webhook.send(ctx, j.callbackURL, payload); err != nil {
+		m.logger.ErrorContext(ctx, "error on job callback", slog.String("id", j.id), slog.String("url", j.callbackURL), slog.String("err", err.Error()))
+	}
+}
+
+// finish stores the result of the job and removes it from the job queue. The
+// job fails with errJobStorageFull if the result would exceed the maximum size
+// of all stored results.
+func (m *jobManager) finish(j *job, result conversionResult, err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pending--
+	size := int64(len(result.content))
+	if err == nil && m.maxResultSize > 0 && m.resultSize+size > m.maxResultSize {
+		err = errJobStorageFull
+	}
+	if j.setFinished(result, err) && err == nil {
+		m.resultSize += size
+	}
+	return err
+}
+
+// remove deletes the job and frees the size of its result. m.mu must be held.
+func (m *jobManager) remove(j *job) {
+	delete(m.jobs, j.id)
+	state, result := j.finishedState()
+	if state == jobStateDone {
+		m.resultSize -= int64(len(result.content))
+	}
+}
+
+// get returns the job with the given id
+func (m *jobManager) get(id string) (*job, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+// cancel cancels a queued or running job and kills a running pandoc process.
+// The cancelled job is kept until the retention period is over. Finished jobs
+// are removed.
+func (m *jobManager) cancel(id string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	if !ok {
+		return false
+	}
+
+	if !j.setCancelled() {
+		m.remove(j)
+		return true
+	}
+	j.cancel()
+	return true
+}
+
+// shutdown waits until all queued and running jobs are finished and their
+// callbacks are sent. The remaining jobs are cancelled when ctx is done. No
+// new jobs must be submitted after shutdown was called.
+func (m *jobManager) shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		m.running.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		m.stop()
+		return nil
+	case <-ctx.Done():
+		m.stop()
+		<-done
+		return ctx.Err()
+	}
+}
+
+// cleanup removes finished jobs after the retention period. It blocks until
+// ctx is done.
+func (m *jobManager) cleanup(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			m.mu.Lock()
+			for id, j := range m.jobs {
+				j.mu.Lock()
+				expired := !j.finished.IsZero() && now.Sub(j.finished) > m.retention
+				j.mu.Unlock()
+				if expired {
+					m.logger.DebugContext(ctx, "removing expired job", slog.String("id", id))
+					m.remove(j)
+				}
+			}
+			m.mu.Unlock()
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+func TestJobOwnership(t *testing.T) {
+	app := newTestApplication(t, &fakeConverter{}, nil)
+	setTestAPIKeys(t, app, map[string][]string{
+		"alice": {scopeConvert, scopeJobsRead},
+		"bob":   {scopeConvert, scopeJobsRead},
+		"admin": {scopeAdmin},
+	})
+	handler := app.newServer()
+	alice, bob, admin := bearer("alice-token"), bearer("bob-token"), bearer("admin-token")
+
+	rec := postJSON(t, handler, "/jobs", map[string]any{"input": []byte("x"), "output_format": "html"}, alice)
+	if rec.Code != http.StatusAccepted {
+		t.Fatalf("expected status 202, got %d: %s", rec.Code, rec.Body.String())
+	}
+	status := decodeResponse[jobStatus](t, rec)
+	deadline := time.Now().Add(5 * time.Second)
+	for status.State != jobStateDone {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+		status = decodeResponse[jobStatus](t, doRequest(handler, http.MethodGet, "/jobs/"+status.ID, alice))
+	}
+
+	// other clients can not see the job
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/jobs/" + status.ID},
+		{http.MethodGet, "/jobs/" + status.ID + "/result"},
+		{http.MethodDelete, "/jobs/" + status.ID},
+	} {
+		if rec := doRequest(handler, req.method, req.path, bob); rec.Code != http.StatusNotFound {
+			t.Errorf("%s %s: expected status 404 for another client, got %d: %s", req.method, req.path, rec.Code, rec.Body.String())
+		}
+	}
+
+	if rec := doRequest(handler, http.MethodGet, "/jobs/"+status.ID+"/result", alice); rec.Code != http.StatusOK {
+		t.Errorf("expected status 200 for the owner, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(handler, http.MethodGet, "/jobs/"+status.ID, admin); rec.Code != http.StatusOK {
+		t.Errorf("expected status 200 for an admin, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(handler, http.MethodDelete, "/jobs/"+status.ID, admin); rec.Code != http.StatusNoContent {
+		t.Errorf("expected status 204 for an admin, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := doRequest(handler, http.MethodGet, "/jobs/"+status.ID, alice); rec.Code != http.StatusNotFound {
+		t.Errorf("expected the deleted job to be gone, got %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJobPrincipalSources(t *testing.T) {
+	// an API key and a JWT subject with the same name are different clients
+	key := principal{name: "alice", source: principalSourceAPIKey}
+	jwt := principal{name: "alice", source: principalSourceJWT}
+	if key.id() == jwt.id() {
+		t.Fatalf("principals of different sources share the id %q", key.id())
+	}
+}
+
+func waitForJobState(t *testing.T, j *job, states ...jobState) jobStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := j.status(time.Hour)
+		if slices.Contains(states, status.State) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not reach %v: %+v", states, status)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestJobCacheHitHasStartTime(t *testing.T) {
+	fake := &fakeConverter{}
+	app := newTestApplication(t, fake, func(c *config.Configuration) {
+		c.Cache.MaxSize = 1 << 20
+	})
+	conv := testConversion(t, "markdown", "html")
+
+	for _, want := range []string{"first", "cached"} {
+		j, err := app.jobs.submit("", "", conv, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		status := waitForJobState(t, j, jobStateDone)
+		if status.StartedAt == nil {
+			t.Errorf("%s job has no start time: %+v", want, status)
+		}
+	}
+	if len(fake.calls()) != 1 {
+		t.Errorf("expected the second job to be served from the cache, got %d conversions", len(fake.calls()))
+	}
+}
+
+func TestJobShutdown(t *testing.T) {
+	t.Run("drains running jobs", func(t *testing.T) {
+		fake := &fakeConverter{block: make(chan struct{})}
+		app := newTestApplication(t, fake, nil)
+		j, err := app.jobs.submit("", "", testConversion(t, "markdown", "html"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForJobState(t, j, jobStateRunning)
+
+		done := make(chan error)
+		go func() {
+			done <- app.jobs.shutdown(context.Background())
+		}()
+		select {
+		case err := <-done:
+			t.Fatalf("shutdown returned before the job finished: %v", err)
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		close(fake.block)
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		if state, _ := j.finishedState(); state != jobStateDone {
+			t.Errorf("expected the job to be done, got %s", state)
+		}
+	})
+
+	t.Run("cancels jobs after the timeout", func(t *testing.T) {
+		fake := &fakeConverter{block: make(chan struct{})}
+		app := newTestApplication(t, fake, nil)
+		j, err := app.jobs.submit("", "", testConversion(t, "markdown", "html"), "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		waitForJobState(t, j, jobStateRunning)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		if err := app.jobs.shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected a deadline error, got %v", err)
+		}
+		if state, _ := j.finishedState(); state != jobStateFailed {
+			t.Errorf("expected the job to fail, got %s", state)
+		}
+	})
+}
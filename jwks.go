@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	// jwksMaxSize limits the size of a JWKS fetched from a url
+	jwksMaxSize = 1 << 20
+	// jwksMinRefreshInterval limits how often unknown key ids trigger a reload
+	jwksMinRefreshInterval = 1 * time.Minute
+	// jwksFetchTimeout limits how long fetching the JWKS from a url may take
+	jwksFetchTimeout = 10 * time.Second
+)
+
+var errUnknownJWK = errors.New("unknown signing key")
+
+// jwk is a single key of a JSON Web Key Set as defined in RFC 7517
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jwksProvider holds the keys used to validate JWTs. The keys are read from
+// a file or url and reloaded periodically so rotated keys are picked up.
+type jwksProvider struct {
+	logger *slog.Logger
+	file   string
+	url    string
+	client *http.Client
+
+	mu   sync.RWMutex
+	keys map[string]crypto.PublicKey
+
+	// refreshMu makes sure only one reload runs at a time
+	refreshMu sync.Mutex
+	// lastRefresh is the time of the last reload, successful or not
+	lastRefresh time.Time
+}
+
+// newJWKSProvider loads the keys and reloads them every interval until ctx is done
+func newJWKSProvider(ctx context.Context, logger *slog.Logger, file, url string, interval time.Duration) (*jwksProvider, error) {
+	p := &jwksProvider{
+		logger: logger,
+		file:   file,
+		url:    url,
+		client: &http.Client{Timeout: jwksFetchTimeout},
+	}
+	if err := p.refresh(ctx); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				// keep the old keys if the reload fails
+				if err := p.refresh(ctx); err != nil {
+					p.logger.ErrorContext(ctx, "could not reload jwks", slog.String("err", err.Error()))
+				}
+			}
+		}
+	}()
+
+	return p, nil
+}
+
+// refresh reads the keys from the file or url and replaces the current keys
+func (p *jwksProvider) refresh(ctx context.Context) error {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	return p.load(ctx)
+}
+
+// refreshIfStale reloads the keys unless they were reloaded in the last
+// jwksMinRefreshInterval. The reload is not canceled with the request that
+// triggered it as other requests wait for the same reload.
+func (p *jwksProvider) refreshIfStale(ctx context.Context) {
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	if time.Since(p.lastRefresh) < jwksMinRefreshInterval {
+		return
+	}
+	loadCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), jwksFetchTimeout)
+	defer cancel()
+	if err := p.load(loadCtx); err != nil {
+		p.logger.ErrorContext(ctx, "could not reload jwks", slog.String("err", err.Error()))
+	}
+}
+
+// load replaces the current keys. p.refreshMu must be held.
+func (p *jwksProvider) load(ctx context.Context) error {
+	p.lastRefresh = time.Now()
+	content, err := p.read(ctx)
+	if err != nil {
+		return err
+	}
+	keys, err := parseJWKS(content)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.mu.Unlock()
+
+	p.logger.DebugContext(ctx, "loaded jwks", slog.Int("keys", len(keys)))
+	return nil
+}
+
+func (p *jwksProvider) read(ctx context.Context) ([]byte, error) {
+	if p.file != "" {
+		content, err := os.ReadFile(p.file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read jwks file: %w", err)
+		}
+		return content, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not create jwks request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("could not fetch jwks: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("could not fetch jwks: status %d", resp.StatusCode)
+	}
+	content, err := io.ReadAll(io.LimitReader(resp.Body, jwksMaxSize))
+	if err != nil {
+		return nil, fmt.Errorf("could not read jwks response: %w", err)
+	}
+	return content, nil
+}
+
+// key returns the key with the given id. If the key is unknown the keys are
+// reloaded as the issuer might have rotated them, but not more than once
+// every jwksMinRefreshInterval.
+func (p *jwksProvider) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+
+	p.refreshIfStale(ctx)
+	if key, ok := p.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, errUnknownJWK
+}
+
+// lookup returns the key with the given id. Tokens without a key id can only
+// be validated if the set contains a single key.
+func (p *jwksProvider) lookup(kid string) (crypto.PublicKey, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, true
+		}
+	}
+	key, ok := p.keys[kid]
+	return key, ok
+}
+
+// keyfunc returns the jwt.Keyfunc used to validate tokens
+func (p *jwksProvider) keyfunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (any, error) {
+		kid, _ := token.Header["kid"].(string)
+		return p.key(ctx, kid)
+	}
+}
+
+// parseJWKS parses a JSON Web Key Set. Only RSA, EC and Ed25519 signing keys
+// are used, all other keys are skipped.
+func parseJWKS(content []byte) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, fmt.Errorf("could not parse jwks: %w", err)
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q in jwks: %w", k.Kid, err)
+		}
+		if key == nil {
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("jwks does not contain any signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey returns the public key or nil if the key type is not supported
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent: %w", err)
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid exponent")
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid x coordinate: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid y coordinate: %w", err)
+		}
+		// uncompressed point encoding, coordinates are padded to the curve size
+		size := (curve.Params().BitSize + 7) / 8
+		if len(x) > size || len(y) > size {
+			return nil, errors.New("invalid coordinates")
+		}
+		point := make([]byte, 1+2*size)
+		point[0] = 4
+		copy(point[1+size-len(x):1+size], x)
+		copy(point[1+2*size-len(y):], y)
+		return ecdsa.ParseUncompressedPublicKey(curve, point)
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key: %w", err)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid public key size")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, nil
+	}
+}
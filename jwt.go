@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"strings"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwtValidator validates bearer JWTs and maps their claims to permissions
+type jwtValidator struct {
+	config config.ConfigJWT
+	jwks   *jwksProvider
+	parser *jwt.Parser
+}
+
+// newJWTValidator returns nil if no JWKS is configured
+func newJWTValidator(ctx context.Context, logger *slog.Logger, configuration config.ConfigJWT) (*jwtValidator, error) {
+	if configuration.JWKSFile == "" && configuration.JWKSURL == "" {
+		return nil, nil
+	}
+
+	jwks, err := newJWKSProvider(ctx, logger, configuration.JWKSFile, configuration.JWKSURL, configuration.JWKSRefreshInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	return &jwtValidator{
+		config: configuration,
+		jwks:   jwks,
+		parser: jwt.NewParser(
+			jwt.WithValidMethods(configuration.Algorithms),
+			jwt.WithIssuer(configuration.Issuer),
+			jwt.WithAudience(configuration.Audience),
+			jwt.WithExpirationRequired(),
+			jwt.WithIssuedAt(),
+			jwt.WithLeeway(configuration.Leeway),
+		),
+	}, nil
+}
+
+// looksLikeJWT returns true if the token has the three parts of a JWS
+func looksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// validate checks the signature and the registered claims of the token and
+// returns the permissions granted by it
+func (v *jwtValidator) validate(ctx context.Context, token string) (principal, error) {
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(token, claims, v.jwks.keyfunc(ctx)); err != nil {
+		return principal{}, err
+	}
+
+	subject, err := claims.GetSubject()
+	if err != nil {
+		return principal{}, err
+	}
+	if subject == "" {
+		return principal{}, errors.New("token has no subject")
+	}
+
+	p := principal{
+		name:   subject,
+		source: principalSourceJWT,
+	}
+
+	// scopes are usually a space separated string (RFC 8693) but some
+	// providers use a list
+	scopes, err := stringListClaim(claims, v.config.ScopesClaim, true)
+	if err != nil {
+		return principal{}, err
+	}
+	for _, scope := range scopes {
+		// other scopes of the identity provider are ignored
+		if slices.Contains(validScopes, scope) {
+			p.scopes = append(p.scopes, scope)
+		}
+	}
+
+	if _, ok := claims[v.config.TemplatesClaim]; ok {
+		p.templates, err = stringListClaim(claims, v.config.TemplatesClaim, false)
+		if err != nil {
+			return principal{}, err
+		}
+		// an empty list must not be mistaken for no restriction
+		if p.templates == nil {
+			p.templates = []string{}
+		}
+	}
+
+	if value, ok := claims[v.config.MaxInputSizeClaim]; ok {
+		size, ok := value.(float64)
+		if !ok || size <= 0 || size > math.MaxInt64 || size != math.Trunc(size) {
+			return principal{}, fmt.Errorf("claim %q must be a positive integer", v.config.MaxInputSizeClaim)
+		}
+		p.maxInputSize = int64(size)
+	}
+
+	return p, nil
+}
+
+// stringListClaim returns the claim as a list of strings. The claim can be a
+// list of strings or, if splitString is true, a space separated string.
+func stringListClaim(claims jwt.MapClaims, name string, splitString bool) ([]string, error) {
+	switch value := claims[name].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		if splitString {
+			return strings.Fields(value), nil
+		}
+		return []string{value}, nil
+	case []any:
+		ret := make([]string, 0, len(value))
+		for _, v := range value {
+			s, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("claim %q must only contain strings", name)
+			}
+			ret = append(ret, s)
+		}
+		return ret, nil
+	default:
+		return nil, fmt.Errorf("claim %q must be a string or a list of strings", name)
+	}
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	testJWTIssuer   = "https://issuer.example.com"
+	testJWTAudience = "pandocserver"
+)
+
+// testJWKS is a JWKS file with Ed25519 keys used to sign test tokens
+type testJWKS struct {
+	file string
+	keys map[string]ed25519.PrivateKey
+}
+
+func newTestJWKS(t *testing.T) *testJWKS {
+	t.Helper()
+	s := &testJWKS{
+		file: filepath.Join(t.TempDir(), "jwks.json"),
+		keys: make(map[string]ed25519.PrivateKey),
+	}
+	s.addKey(t, "key-1")
+	return s
+}
+
+// addKey generates a new key and rewrites the JWKS file
+func (s *testJWKS) addKey(t *testing.T, kid string) {
+	t.Helper()
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.keys[kid] = private
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	for kid, key := range s.keys {
+		set.Keys = append(set.Keys, jwk{
+			Kty: "OKP",
+			Kid: kid,
+			Use: "sig",
+			Crv: "Ed25519",
+			X:   base64.RawURLEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+		})
+	}
+	content, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(s.file, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign returns a token signed with the key. The registered claims are set to
+// valid values unless they are overwritten by claims.
+func (s *testJWKS) sign(t *testing.T, kid string, claims jwt.MapClaims) string {
+	t.Helper()
+	all := jwt.MapClaims{
+		"iss": testJWTIssuer,
+		"aud": testJWTAudience,
+		"sub": "user-1",
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for name, value := range claims {
+		all[name] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, all)
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(s.keys[kid])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func newTestJWTValidator(t *testing.T, jwks *testJWKS) *jwtValidator {
+	t.Helper()
+	configuration, err := config.GetConfig(writeTestConfig(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwtConfig := configuration.Auth.JWT
+	jwtConfig.JWKSFile = jwks.file
+	jwtConfig.Issuer = testJWTIssuer
+	jwtConfig.Audience = testJWTAudience
+
+	v, err := newJWTValidator(t.Context(), slog.New(slog.NewTextHandler(io.Discard, nil)), jwtConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestJWTValidate(t *testing.T) {
+	jwks := newTestJWKS(t)
+	v := newTestJWTValidator(t, jwks)
+
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+		want   string
+	}{
+		{name: "valid"},
+		{name: "issuer mismatch", claims: jwt.MapClaims{"iss": "https://other.example.com"}, want: "invalid issuer"},
+		{name: "audience mismatch", claims: jwt.MapClaims{"aud": "other"}, want: "invalid audience"},
+		{name: "expired", claims: jwt.MapClaims{"exp": time.Now().Add(-time.Hour).Unix()}, want: "token is expired"},
+		{name: "missing subject", claims: jwt.MapClaims{"sub": ""}, want: "token has no subject"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.validate(t.Context(), jwks.sign(t, "key-1", tt.claims))
+			if tt.want == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if p.name != "user-1" || p.source != principalSourceJWT {
+					t.Errorf("unexpected principal %+v", p)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("expected an error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
+
+func TestJWTUnknownKeyReloadsJWKS(t *testing.T) {
+	jwks := newTestJWKS(t)
+	v := newTestJWTValidator(t, jwks)
+
+	// the issuer rotated its keys
+	jwks.addKey(t, "key-2")
+	token := jwks.sign(t, "key-2", nil)
+
+	// the keys were just loaded so they are not reloaded again
+	if _, err := v.validate(t.Context(), token); err == nil {
+		t.Fatal("expected an error as the keys were reloaded too recently")
+	}
+
+	v.jwks.refreshMu.Lock()
+	v.jwks.lastRefresh = time.Time{}
+	v.jwks.refreshMu.Unlock()
+	if _, err := v.validate(t.Context(), token); err != nil {
+		t.Fatalf("unknown key was not reloaded: %v", err)
+	}
+
+	// keys that are not in the file are still rejected after a reload
+	_, unknown, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks.keys["unknown"] = unknown
+	v.jwks.refreshMu.Lock()
+	v.jwks.lastRefresh = time.Time{}
+	v.jwks.refreshMu.Unlock()
+	if _, err := v.validate(t.Context(), jwks.sign(t, "unknown", nil)); err == nil {
+		t.Fatal("expected an error for a key that is not in the jwks")
+	}
+}
+
+func TestJWTClaims(t *testing.T) {
+	jwks := newTestJWKS(t)
+	v := newTestJWTValidator(t, jwks)
+
+	tests := []struct {
+		name         string
+		claims       jwt.MapClaims
+		scopes       []string
+		templates    []string
+		maxInputSize int64
+		wantErr      bool
+	}{
+		{name: "no claims"},
+		{name: "space separated scopes", claims: jwt.MapClaims{"scope": "openid convert jobs:read"}, scopes: []string{scopeConvert, scopeJobsRead}},
+		{name: "scope list", claims: jwt.MapClaims{"scope": []string{"admin", "profile"}}, scopes: []string{scopeAdmin}},
+		{name: "templates", claims: jwt.MapClaims{"pandoc_templates": []string{"eisvogel", "report"}}, templates: []string{"eisvogel", "report"}},
+		{name: "no templates", claims: jwt.MapClaims{"pandoc_templates": []string{}}, templates: []string{}},
+		{name: "max input size", claims: jwt.MapClaims{"pandoc_max_input_size": 1024}, maxInputSize: 1024},
+		{name: "invalid max input size", claims: jwt.MapClaims{"pandoc_max_input_size": -1}, wantErr: true},
+		{name: "fractional max input size", claims: jwt.MapClaims{"pandoc_max_input_size": 1.5}, wantErr: true},
+		{name: "invalid scopes", claims: jwt.MapClaims{"scope": 1}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := v.validate(t.Context(), jwks.sign(t, "key-1", tt.claims))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", p)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(p.scopes, tt.scopes) {
+				t.Errorf("expected scopes %v, got %v", tt.scopes, p.scopes)
+			}
+			if !slices.Equal(p.templates, tt.templates) || (p.templates == nil) != (tt.templates == nil) {
+				t.Errorf("expected templates %#v, got %#v", tt.templates, p.templates)
+			}
+			if p.maxInputSize != tt.maxInputSize {
+				t.Errorf("expected max input size %d, got %d", tt.maxInputSize, p.maxInputSize)
+			}
+		})
+	}
+}
+
+func TestConvertMaxInputSize(t *testing.T) {
+	jwks := newTestJWKS(t)
+	fake := &fakeConverter{}
+	app := newTestApplication(t, fake, nil)
+	app.jwt = newTestJWTValidator(t, jwks)
+	handler := app.newServer()
+	header := http.Header{"Authorization": {"Bearer " + jwks.sign(t, "key-1", jwt.MapClaims{
+		"scope":                 scopeConvert,
+		"pandoc_max_input_size": 100,
+	})}}
+
+	tests := []struct {
+		name   string
+		input  []byte
+		status int
+		want   string
+	}{
+		{name: "within the limit", input: make([]byte, 100), status: http.StatusOK},
+		{name: "decoded input too large", input: make([]byte, 101), status: http.StatusRequestEntityTooLarge, want: "input exceeds the size limit of 100 bytes"},
+		// the body is rejected while reading it
+		{name: "body too large", input: make([]byte, 2*requestBodyOverhead), status: http.StatusRequestEntityTooLarge, want: "request body exceeds the size limit"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(t, handler, "/convert", map[string]any{"input": tt.input, "output_format": "html"}, header)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+			if tt.want != "" {
+				if resp := decodeResponse[errorResponse](t, rec); !strings.HasPrefix(resp.Error, tt.want) {
+					t.Errorf("expected error %q, got %q", tt.want, resp.Error)
+				}
+			}
+		})
+	}
+	if len(fake.calls()) != 1 {
+		t.Errorf("expected one conversion, got %d", len(fake.calls()))
+	}
+}
+
+func TestAuthenticateAPIKeyWithDots(t *testing.T) {
+	jwks := newTestJWKS(t)
+	app := newTestApplication(t, &fakeConverter{}, nil)
+	app.jwt = newTestJWTValidator(t, jwks)
+	setTestAPIKeys(t, app, map[string][]string{"key.with.dots": {scopeConvert}})
+	handler := app.newServer()
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{name: "api key containing two dots", token: "key.with.dots-token", status: http.StatusOK},
+		{name: "jwt", token: jwks.sign(t, "key-1", jwt.MapClaims{"scope": scopeConvert}), status: http.StatusOK},
+		{name: "unknown token with two dots", token: "not.a.token", status: http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := postJSON(t, handler, "/convert", map[string]any{"input": []byte("x"), "output_format": "html"}, bearer(tt.token))
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestJWKSReloadOutlivesRequest(t *testing.T) {
+	jwks := newTestJWKS(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, jwks.file)
+	}))
+	t.Cleanup(srv.Close)
+	p, err := newJWKSProvider(t.Context(), slog.New(slog.NewTextHandler(io.Discard, nil)), "", srv.URL, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jwks.addKey(t, "key-2")
+	p.refreshMu.Lock()
+	p.lastRefresh = time.Time{}
+	p.refreshMu.Unlock()
+
+	// the client that triggered the reload went away
+	ctx, cancel := context.WithCancel(t.Context())
+	cancel()
+	if _, err := p.key(ctx, "key-2"); err != nil {
+		t.Fatalf("keys were not reloaded: %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// the limit names are returned to the client as error codes
+const (
+	limitAddressSpace = "memory_limit_exceeded"
+	limitCPUTime      = "cpu_time_limit_exceeded"
+	limitFileSize     = "file_size_limit_exceeded"
+	limitOpenFiles    = "open_files_limit_exceeded"
+	limitProcesses    = "process_limit_exceeded"
+)
+
+// resourceLimitError is returned if the pandoc process tree hit one of the
+// configured resource limits
+type resourceLimitError struct {
+	limit string
+	err   error
+}
+
+func (e *resourceLimitError) Error() string {
+	return fmt.Sprintf("%s: %v", e.limit, e.err)
+}
+
+func (e *resourceLimitError) Unwrap() error {
+	return e.err
+}
+
+func resourceLimitsEnabled(limits config.ConfigLimits) bool {
+	return limits.AddressSpace > 0 || limits.CPUTime > 0 || limits.FileSize > 0 || limits.OpenFiles > 0 || limits.Processes > 0
+}
+
+// limitEnabled returns true if the limit with the given name is configured
+func limitEnabled(limits config.ConfigLimits, limit string) bool {
+	switch limit {
+	case limitAddressSpace:
+		return limits.AddressSpace > 0
+	case limitCPUTime:
+		return limits.CPUTime > 0
+	case limitFileSize:
+		return limits.FileSize > 0
+	case limitOpenFiles:
+		return limits.OpenFiles > 0
+	case limitProcesses:
+		return limits.Processes > 0
+	default:
+		return false
+	}
+}
+
+// stderrLimitHints maps messages printed by pandoc and the LaTeX engines to
+// the limit that most likely caused them. As stderr can also contain text
+// from the document, a hint is only used if its limit is configured.
+var stderrLimitHints = []struct {
+	hint  string
+	limit string
+}{
+	{hint: "out of memory", limit: limitAddressSpace},
+	{hint: "cannot allocate memory", limit: limitAddressSpace},
+	{hint: "memory allocation failed", limit: limitAddressSpace},
+	{hint: "heap overflow", limit: limitAddressSpace},
+	{hint: "file too large", limit: limitFileSize},
+	{hint: "too many open files", limit: limitOpenFiles},
+	{hint: "resource temporarily unavailable", limit: limitProcesses},
+	{hint: "cannot fork", limit: limitProcesses},
+}
+
+// checkResourceLimits tries to determine if the command failed because of
+// one of the configured resource limits. The signal that terminated the
+// process is preferred over the messages on stderr. It returns nil if the
+// error is not related to a resource limit.
+func checkResourceLimits(limits config.ConfigLimits, err error, stderr string) error {
+	if !resourceLimitsEnabled(limits) {
+		return nil
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if limit := limitFromExitError(limits, exitErr); limit != "" && limitEnabled(limits, limit) {
+			return &resourceLimitError{limit: limit, err: err}
+		}
+		// the process was killed by another signal, e.g. on a timeout
+		if exitErr.ExitCode() == -1 {
+			return nil
+		}
+	}
+
+	lowerStderr := strings.ToLower(stderr)
+	for _, h := range stderrLimitHints {
+		if limitEnabled(limits, h.limit) && strings.Contains(lowerStderr, h.hint) {
+			return &resourceLimitError{limit: h.limit, err: err}
+		}
+	}
+
+	return nil
+}
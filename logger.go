@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"log/slog"
 	"os"
 	"strings"
@@ -50,5 +51,26 @@ func newLogger(debugMode, jsonOutput bool) *slog.Logger {
 		}
 		handler = tint.NewTextHandler(w, textOptions)
 	}
-	return slog.New(handler)
+	return slog.New(&contextHandler{Handler: handler})
+}
+
+// contextHandler adds the request id stored in the context to every record.
+// The *Context methods of the logger need to be used for this to work.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		r.AddAttrs(slog.String("request_id", requestID))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const luaFilterExtension = ".lua"
+
+var errUnknownLuaFilter = errors.New("unknown lua filter")
+
+// luaFilterRegistry holds the lua filters registered by the operator. Every
+// filter is stored as <name>.lua inside the configured directory. Clients
+// can only enable filters by name, filter code sent by clients is never
+// executed.
+type luaFilterRegistry struct {
+	dir string
+}
+
+// newLuaFilterRegistry returns a new registry. The directory is converted to
+// an absolute path as pandoc runs inside the working directory.
+func newLuaFilterRegistry(dir string) (*luaFilterRegistry, error) {
+	if dir == "" {
+		return &luaFilterRegistry{}, nil
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not get absolute path of lua filters dir %q: %w", dir, err)
+	}
+	return &luaFilterRegistry{dir: abs}, nil
+}
+
+// list returns the names of all registered filters
+func (r *luaFilterRegistry) list() ([]string, error) {
+	names := []string{}
+	if r.dir == "" {
+		return names, nil
+	}
+
+	entries, err := os.ReadDir(r.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return names, nil
+		}
+		return nil, fmt.Errorf("could not read lua filters dir: %w", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), luaFilterExtension)
+		if !ok || !entry.Type().IsRegular() || !templateNameRegex.MatchString(name) {
+			continue
+		}
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names, nil
+}
+
+// resolve returns the absolute paths of the filters in the given order
+func (r *luaFilterRegistry) resolve(names []string) ([]string, error) {
+	paths := make([]string, 0, len(names))
+	for _, name := range names {
+		if r.dir == "" || !templateNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("%w %q", errUnknownLuaFilter, name)
+		}
+		filterPath := filepath.Join(r.dir, name+luaFilterExtension)
+		info, err := os.Stat(filterPath)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("%w %q", errUnknownLuaFilter, name)
+			}
+			return nil, fmt.Errorf("could not stat lua filter %q: %w", name, err)
+		}
+		if !info.Mode().IsRegular() {
+			return nil, fmt.Errorf("%w %q", errUnknownLuaFilter, name)
+		}
+		paths = append(paths, filterPath)
+	}
+	return paths, nil
+}
@@ -4,31 +4,59 @@
 	"context"
 	"errors"
 	"flag"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
 	"github.com/firefart/pandocserver/internal/config"
 
 	"github.com/nikoksr/notify"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 
 	_ "net/http/pprof"
 )
 
 var secretKeyHeaderName = http.CanonicalHeaderKey("X-Secret-Key-Header")
 var cloudflareIPHeaderName = http.CanonicalHeaderKey("CF-Connecting-IP")
+var requestIDHeaderName = http.CanonicalHeaderKey("X-Request-ID")
+
+// keys used to store values in the echo context
+const (
+	contextKeyCacheStatus = "cache_status"
+	contextKeyPrincipal   = "principal"
+)
 
 type application struct {
-	logger *slog.Logger
-	debug  bool
-	config config.Configuration
-	notify *notify.Notify
+	logger     *slog.Logger
+	debug      bool
+	config     config.Configuration
+	notify     *notify.Notify
+	jobs       *jobManager
+	pool       *workerPool
+	converter  converter
+	cache      *conversionCache
+	templates  *templateStore
+	profiles   map[string]profile
+	styles     *styleStore
+	luaFilters *luaFilterRegistry
+	apiKeys    []apiKey
+	jwt        *jwtValidator
 }
 
 func main() {
+	// the server binary sets the resource limits for pandoc, see
+	// resourceLimitCommand
+	if len(os.Args) > 1 && os.Args[1] == resourceLimitHelperArg {
+		err := runResourceLimitHelper(os.Args[2:])
+		fmt.Fprintf(os.Stderr, "could not run pandoc with resource limits: %v\n", err)
+		os.Exit(126)
+	}
+
 	var debugMode bool
 	var configFilename string
 	var jsonOutput bool
@@ -60,11 +88,54 @@ func run(ctx context.Context, logger *slog.Logger, configFilename string, debug
 	}
 	app.config = configuration
 
+	if configuration.Limits.Processes > 0 {
+		logger.Warn("limits.processes limits the number of processes of the user running the server and not only the processes of a conversion, requests may fail if the server runs other processes as the same user")
+	}
+
 	app.notify, err = setupNotifications(configuration, logger)
 	if err != nil {
 		return err
 	}
 
+	shutdownTracing, err := setupTracing(ctx, configuration.Tracing, logger)
+	if err != nil {
+		return err
+	}
+
+	app.apiKeys, err = loadAPIKeys(configuration.Auth.APIKeys)
+	if err != nil {
+		return err
+	}
+
+	app.jwt, err = newJWTValidator(ctx, logger, configuration.Auth.JWT)
+	if err != nil {
+		return err
+	}
+
+	app.templates = newTemplateStore(configuration.TemplatesDir, configuration.PandocDataDir)
+
+	app.styles = newStyleStore(configuration.CSLDir)
+
+	app.luaFilters, err = newLuaFilterRegistry(configuration.LuaFiltersDir)
+	if err != nil {
+		return err
+	}
+
+	app.profiles, err = loadProfiles(configuration.Profiles)
+	if err != nil {
+		return err
+	}
+
+	backend := newConverter(ctx, configuration, logger)
+	app.converter = &instrumentedConverter{next: backend}
+
+	app.pool = newWorkerPool(configuration.Workers.MaxConcurrent, configuration.Workers.QueueSize)
+	registerPoolMetrics(app.pool)
+	app.cache = newConversionCache(configuration.Cache.MaxSize, configuration.Cache.TTL)
+	// jobs are not cancelled by the shutdown signal, they are drained on shutdown
+	app.jobs = newJobManager(context.WithoutCancel(ctx), logger, configuration.Jobs, app.converter, newWebhookSender(configuration.Webhooks, logger), app.pool, app.cache, configuration.HideDiagnostics)
+	go app.jobs.cleanup(ctx, time.Minute)
+
 	tlsConfig, err := app.setupTLSConfig()
 	if err != nil {
 		return err
@@ -74,12 +145,19 @@ func run(ctx context.Context, logger *slog.Logger, configFilename string, debug
 		slog.String("host", configuration.Server.Listen),
 		slog.Duration("gracefultimeout", configuration.Server.GracefulTimeout),
 		slog.Duration("timeout", configuration.Timeout),
+		slog.String("pandoc_server", configuration.PandocServer.URL),
+		slog.Int("workers", configuration.Workers.MaxConcurrent),
+		slog.Int("queue_size", configuration.Workers.QueueSize),
+		slog.Int64("cache_size", configuration.Cache.MaxSize),
+		slog.String("tracing_endpoint", configuration.Tracing.Endpoint),
+		slog.Int("api_keys", len(app.apiKeys)),
+		slog.Bool("jwt", app.jwt != nil),
 		slog.Bool("debug", app.debug),
 	)
 
 	srv := &http.Server{
 		Addr:         configuration.Server.Listen,
-		Handler:      app.newServer(ctx),
+		Handler:      app.newServer(),
 		TLSConfig:    tlsConfig,
 		ReadTimeout:  configuration.Timeout,
 		WriteTimeout: configuration.Timeout,
@@ -103,6 +181,10 @@ func run(ctx context.Context, logger *slog.Logger, configFilename string, debug
 	go func() {
 		pprofMux := http.NewServeMux()
 		pprofMux.Handle("/debug/pprof/", http.DefaultServeMux)
+		// metrics are served on the pprof listener if there is no separate one
+		if app.config.Server.MetricsListen == "" {
+			pprofMux.Handle("/metrics", promhttp.Handler())
+		}
 		pprofSrv.Handler = pprofMux
 		if err := pprofSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 			app.logger.Error("error on pprof listenandserve", slog.String("err", err.Error()))
@@ -111,6 +193,27 @@ func run(ctx context.Context, logger *slog.Logger, configFilename string, debug
 		}
 	}()
 
+	var metricsSrv *http.Server
+	if app.config.Server.MetricsListen != "" {
+		app.logger.Info("Starting metrics server",
+			slog.String("host", app.config.Server.MetricsListen),
+		)
+
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", promhttp.Handler())
+		metricsSrv = &http.Server{
+			Addr:    app.config.Server.MetricsListen,
+			Handler: metricsMux,
+		}
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error("error on metrics listenandserve", slog.String("err", err.Error()))
+				// emit signal to kill server
+				cancel()
+			}
+		}()
+	}
+
 	var wg sync.WaitGroup
 	wg.Go(func() {
 		// wait for a signal
@@ -125,6 +228,19 @@ func run(ctx context.Context, logger *slog.Logger, configFilename string, debug
 		if err := pprofSrv.Shutdown(shutdownCtx); err != nil {
 			app.logger.Error("error on pprofsrv shutdown", slog.String("err", err.Error()))
 		}
+		if metricsSrv != nil {
+			if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+				app.logger.Error("error on metricssrv shutdown", slog.String("err", err.Error()))
+			}
+		}
+		// no new jobs can be created once the server is shut down
+		if err := app.jobs.shutdown(shutdownCtx); err != nil {
+			app.logger.Error("error on jobs shutdown", slog.String("err", err.Error()))
+		}
+		// flush the remaining spans after all requests and jobs are finished
+		if err := shutdownTracing(shutdownCtx); err != nil {
+			app.logger.Error("error on tracing shutdown", slog.String("err", err.Error()))
+		}
 	})
 	wg.Wait()
 	return nil
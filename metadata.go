@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"unicode"
+
+	"go.yaml.in/yaml/v3"
+)
+
+const defaultDocumentName = "document"
+
+// documentTitle returns the title from the yaml metadata block at the start
+// of the document. If there is no such block or no title an empty string
+// is returned.
+func documentTitle(input []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(input)+1)
+
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) != "---" {
+		return ""
+	}
+
+	var block bytes.Buffer
+	closed := false
+	for scanner.Scan() {
+		line := scanner.Text()
+		if trimmed := strings.TrimSpace(line); trimmed == "---" || trimmed == "..." {
+			closed = true
+			break
+		}
+		block.WriteString(line)
+		block.WriteByte('\n')
+	}
+	if !closed {
+		return ""
+	}
+
+	var metadata struct {
+		Title any `yaml:"title"`
+	}
+	if err := yaml.Unmarshal(block.Bytes(), &metadata); err != nil {
+		return ""
+	}
+	title, ok := metadata.Title.(string)
+	if !ok {
+		return ""
+	}
+	return title
+}
+
+// filenameFromTitle converts a document title into a filename usable in a
+// Content-Disposition header
+func filenameFromTitle(title, extension string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case unicode.IsLetter(r), unicode.IsDigit(r), r == '-', r == '_', r == '.':
+			return r
+		case unicode.IsSpace(r):
+			return '_'
+		default:
+			return -1
+		}
+	}, title)
+	name = strings.Trim(name, "._")
+	if name == "" {
+		name = defaultDocumentName
+	}
+	return name + "." + extension
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const metricsNamespace = "pandocserver"
+
+// values of the result label of the conversions metric
+const (
+	conversionResultSuccess       = "success"
+	conversionResultTimeout       = "timeout"
+	conversionResultResourceLimit = "resource_limit"
+	conversionResultCancelled     = "cancelled"
+	conversionResultError         = "error"
+)
+
+var (
+	metricConversionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversion_duration_seconds",
+		Help:      "Duration of the conversions by template, output format and pdf engine.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"template", "format", "engine"})
+
+	metricConversions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversions_total",
+		Help:      "Number of finished conversions by result (success, timeout, resource_limit, cancelled or error).",
+	}, []string{"result"})
+
+	metricConversionsInFlight = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversions_in_flight",
+		Help:      "Number of currently running pandoc conversions.",
+	})
+
+	metricInputBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversion_input_bytes",
+		Help:      "Size of the input documents including resources.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+
+	metricOutputBytes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversion_output_bytes",
+		Help:      "Size of the converted documents.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+
+	metricQueueRejections = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_rejections_total",
+		Help:      "Number of requests rejected because no worker was available by reason (full or timeout).",
+	}, []string{"reason"})
+
+	metricCacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Number of cache lookups by status (hit, miss or shared).",
+	}, []string{"status"})
+
+	metricNotificationFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "notification_failures_total",
+		Help:      "Number of error notifications that could not be sent.",
+	})
+)
+
+// registerPoolMetrics exposes the state of the worker pool
+func registerPoolMetrics(pool *workerPool) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "workers",
+		Help:      "Maximum number of concurrent conversions.",
+	}, func() float64 { return float64(pool.workers()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "active_workers",
+		Help:      "Number of busy workers.",
+	}, func() float64 { return float64(pool.active()) })
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "Number of requests waiting for a free worker.",
+	}, func() float64 { return float64(pool.queueDepth()) })
+}
+
+// instrumentedConverter records the metrics and a span of every conversion
+type instrumentedConverter struct {
+	next converter
+}
+
+func (c *instrumentedConverter) convert(ctx context.Context, conv conversion) (conversionResult, error) {
+	ctx, span := tracer.Start(ctx, "convert", trace.WithAttributes(
+		attribute.String("pandoc.input_format", conv.inputFormat.reader),
+		attribute.String("pandoc.output_format", conv.outputFormat.extension),
+		attribute.String("pandoc.template", conv.template),
+		attribute.String("pandoc.pdf_engine", conv.pdfEngine),
+	))
+
+	inputSize := len(conv.input)
+	for _, content := range conv.resources {
+		inputSize += len(content)
+	}
+	metricInputBytes.Observe(float64(inputSize))
+
+	metricConversionsInFlight.Inc()
+	start := time.Now()
+	result, err := c.next.convert(ctx, conv)
+	metricConversionsInFlight.Dec()
+
+	metricConversionDuration.WithLabelValues(metricLabel(conv.template), conv.outputFormat.extension, metricLabel(conv.pdfEngine)).Observe(time.Since(start).Seconds())
+	metricConversions.WithLabelValues(conversionResultLabel(err)).Inc()
+	if err == nil {
+		metricOutputBytes.Observe(float64(len(result.content)))
+	}
+	span.SetAttributes(attribute.Int("pandoc.input_bytes", inputSize), attribute.Int("pandoc.output_bytes", len(result.content)))
+	endSpan(span, err)
+	return result, err
+}
+
+// metricLabel replaces empty values so they are visible in the metrics
+func metricLabel(value string) string {
+	if value == "" {
+		return "default"
+	}
+	return value
+}
+
+// conversionResultLabel classifies the error of a conversion
+func conversionResultLabel(err error) string {
+	var limitErr *resourceLimitError
+	switch {
+	case err == nil:
+		return conversionResultSuccess
+	case errors.Is(err, errConversionTimeout):
+		return conversionResultTimeout
+	case errors.As(err, &limitErr):
+		return conversionResultResourceLimit
+	case errors.Is(err, context.Canceled):
+		return conversionResultCancelled
+	default:
+		return conversionResultError
+	}
+}
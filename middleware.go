@@ -1,8 +1,9 @@
 package main
 
 import (
-	"context"
+	"crypto/subtle"
 	"log/slog"
+	"net/http"
 
 	"github.com/labstack/echo/v5"
 	"github.com/labstack/echo/v5/middleware"
@@ -12,7 +13,20 @@ func (app *application) middlewareRecover() echo.MiddlewareFunc {
 	return middleware.Recover()
 }
 
-func (app *application) middlewareRequestLogger(ctx context.Context) echo.MiddlewareFunc {
+// middlewareSecretKey only allows requests sending the configured secret key header
+func (app *application) middlewareSecretKey() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			headerValue := c.Request().Header.Get(secretKeyHeaderName)
+			if subtle.ConstantTimeCompare([]byte(headerValue), []byte(app.config.Notifications.SecretKeyHeader)) != 1 {
+				return newEchoJsonError(nil, http.StatusUnauthorized, "invalid or missing secret key header")
+			}
+			return next(c)
+		}
+	}
+}
+
+func (app *application) middlewareRequestLogger() echo.MiddlewareFunc {
 	return middleware.RequestLoggerWithConfig(middleware.RequestLoggerConfig{
 		LogStatus:        true,
 		LogURI:           true,
@@ -31,7 +45,7 @@ func (app *application) middlewareRequestLogger(ctx context.Context) echo.Middle
 				errString = v.Error.Error()
 				logLevel = slog.LevelError
 			}
-			app.logger.LogAttrs(ctx, logLevel, "REQUEST",
+			attrs := []slog.Attr{
 				slog.String("ip", v.RemoteIP),
 				slog.String("method", v.Method),
 				slog.String("uri", v.URI),
@@ -40,7 +54,18 @@ func (app *application) middlewareRequestLogger(ctx context.Context) echo.Middle
 				slog.Duration("request-duration", v.Latency),
 				slog.String("request-length", v.ContentLength), // request content length
 				slog.Int64("response-size", v.ResponseSize),
-				slog.String("err", errString))
+				slog.String("err", errString),
+			}
+			// only set on conversions with enabled cache
+			if cacheStatus, ok := c.Get(contextKeyCacheStatus).(string); ok {
+				attrs = append(attrs, slog.String("cache", cacheStatus))
+			}
+			// only set on authenticated requests
+			if p, ok := c.Get(contextKeyPrincipal).(principal); ok {
+				attrs = append(attrs, slog.String(p.source, p.name))
+			}
+			// the request context holds the request id
+			app.logger.LogAttrs(c.Request().Context(), logLevel, "REQUEST", attrs...)
 
 			return nil
 		},
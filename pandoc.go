@@ -3,6 +3,7 @@
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"math/rand"
@@ -10,7 +11,12 @@
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strings"
+
+	"github.com/firefart/pandocserver/internal/config"
+	"go.yaml.in/yaml/v3"
 )
 
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
@@ -23,23 +29,190 @@ func randStringRunes(n int) string {
 	return string(b)
 }
 
-func (app *application) convert(ctx context.Context, inputFile []byte, resources map[string][]byte, template string) ([]byte, error) {
+// safeJoin joins name to base and makes sure the result does not escape base
+func safeJoin(base, name string) (string, error) {
+	cleaned := filepath.Clean(filepath.Join(base, name))
+	if !strings.HasPrefix(cleaned, base+string(filepath.Separator)) {
+		return "", fmt.Errorf("tried to access file %s which is outside of %s", cleaned, base)
+	}
+	return cleaned, nil
+}
+
+// inputFormat describes the pandoc reader used to parse the input document
+type inputFormat struct {
+	// spec is the reader including its extensions, passed to pandoc via --from
+	spec      string
+	reader    string
+	extension string
+}
+
+const defaultInputFormat = "markdown+yaml_metadata_block+raw_html+emoji"
+
+// inputFormatExtensions maps pandoc readers to the file extension
+// used when writing the input file
+var inputFormatExtensions = map[string]string{
+	"markdown":          "md",
+	"markdown_strict":   "md",
+	"markdown_phpextra": "md",
+	"markdown_mmd":      "md",
+	"gfm":               "md",
+	"commonmark":        "md",
+	"commonmark_x":      "md",
+	"rst":               "rst",
+	"org":               "org",
+	"asciidoc":          "adoc",
+	"latex":             "tex",
+	"html":              "html",
+	"docx":              "docx",
+	"odt":               "odt",
+	"epub":              "epub",
+	"ipynb":             "ipynb",
+	"textile":           "textile",
+	"mediawiki":         "wiki",
+	"docbook":           "xml",
+	"jats":              "xml",
+	"typst":             "typ",
+}
+
+var inputFormatRegex = regexp.MustCompile(`^([a-z0-9_]+)((?:[+-][a-z0-9_]+)*)$`)
+
+// getInputFormat parses a pandoc reader specification like gfm+emoji and
+// checks the reader against the allowed readers. An empty spec returns the
+// default input format.
+func getInputFormat(spec string, allowed []string) (inputFormat, error) {
+	if spec == "" {
+		spec = defaultInputFormat
+	}
+	spec = strings.ToLower(spec)
+	matches := inputFormatRegex.FindStringSubmatch(spec)
+	if matches == nil {
+		return inputFormat{}, fmt.Errorf("invalid input format %q", spec)
+	}
+	reader := matches[1]
+	if !slices.Contains(allowed, reader) {
+		return inputFormat{}, fmt.Errorf("input format %q is not allowed", reader)
+	}
+	extension, ok := inputFormatExtensions[reader]
+	if !ok {
+		extension = "txt"
+	}
+	return inputFormat{
+		spec:      spec,
+		reader:    reader,
+		extension: extension,
+	}, nil
+}
+
+// outputFormat describes a pandoc writer we allow clients to request
+type outputFormat struct {
+	// writer is passed to pandoc via --to. If it's empty pandoc infers
+	// the writer from the extension of the output file (needed for pdf)
+	writer      string
+	extension   string
+	contentType string
+}
+
+const defaultOutputFormat = "pdf"
+
+// outputFormats is the allowlist of output formats supported by the /convert endpoint
+var outputFormats = map[string]outputFormat{
+	"pdf":      {writer: "", extension: "pdf", contentType: "application/pdf"},
+	"docx":     {writer: "docx", extension: "docx", contentType: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+	"odt":      {writer: "odt", extension: "odt", contentType: "application/vnd.oasis.opendocument.text"},
+	"rtf":      {writer: "rtf", extension: "rtf", contentType: "application/rtf"},
+	"pptx":     {writer: "pptx", extension: "pptx", contentType: "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+	"epub":     {writer: "epub3", extension: "epub", contentType: "application/epub+zip"},
+	"html":     {writer: "html5", extension: "html", contentType: "text/html; charset=utf-8"},
+	"typst":    {writer: "typst", extension: "typ", contentType: "text/vnd.typst; charset=utf-8"},
+	"latex":    {writer: "latex", extension: "tex", contentType: "application/x-latex; charset=utf-8"},
+	"markdown": {writer: "markdown", extension: "md", contentType: "text/markdown; charset=utf-8"},
+	"gfm":      {writer: "gfm", extension: "md", contentType: "text/markdown; charset=utf-8"},
+	"rst":      {writer: "rst", extension: "rst", contentType: "text/x-rst; charset=utf-8"},
+	"asciidoc": {writer: "asciidoc", extension: "adoc", contentType: "text/asciidoc; charset=utf-8"},
+	"docbook":  {writer: "docbook5", extension: "xml", contentType: "application/docbook+xml; charset=utf-8"},
+	"plain":    {writer: "plain", extension: "txt", contentType: "text/plain; charset=utf-8"},
+}
+
+// getOutputFormat returns the output format for the given name or an error if
+// the format is not allowed. An empty name returns the default format.
+func getOutputFormat(name string) (outputFormat, error) {
+	if name == "" {
+		name = defaultOutputFormat
+	}
+	format, ok := outputFormats[strings.ToLower(name)]
+	if !ok {
+		return outputFormat{}, fmt.Errorf("invalid output format %q", name)
+	}
+	return format, nil
+}
+
+// execConverter converts documents by running the pandoc binary
+type execConverter struct {
+	logger *slog.Logger
+	config config.Configuration
+}
+
+func newExecConverter(configuration config.Configuration, logger *slog.Logger) *execConverter {
+	return &execConverter{
+		logger: logger,
+		config: configuration,
+	}
+}
+
+func (c *execConverter) convert(ctx context.Context, conv conversion) (conversionResult, error) {
 	tmpdir := path.Join(os.TempDir(), fmt.Sprintf("pandocserver_%s", randStringRunes(10)))
 	if err := os.Mkdir(tmpdir, 0750); err != nil {
-		return nil, fmt.Errorf("could not create dir %q: %w", tmpdir, err)
+		return conversionResult{}, fmt.Errorf("could not create dir %q: %w", tmpdir, err)
 	}
 	defer os.RemoveAll(tmpdir)
 
-	inputFileName := filepath.Join(tmpdir, fmt.Sprintf("%s.md", randStringRunes(10)))
-	if err := os.WriteFile(inputFileName, inputFile, 0600); err != nil {
-		return nil, fmt.Errorf("could not create inputfile: %w", err)
+	staged, err := c.stage(ctx, tmpdir, conv)
+	if err != nil {
+		return conversionResult{}, err
+	}
+
+	if err := c.run(ctx, tmpdir, staged); err != nil {
+		return conversionResult{}, err
+	}
+
+	content, err := os.ReadFile(staged.outputFilename)
+	if err != nil {
+		return conversionResult{}, fmt.Errorf("could not read output file: %w", err)
+	}
+
+	return conversionResult{
+		content:     content,
+		diagnostics: c.readLog(ctx, staged.logFilename),
+	}, nil
+}
+
+// stagedConversion holds the pandoc arguments and the files pandoc writes to
+type stagedConversion struct {
+	args           []string
+	outputFilename string
+	logFilename    string
+}
+
+// stage writes the input and all other files needed for the conversion to
+// the working directory and returns the pandoc arguments
+func (c *execConverter) stage(ctx context.Context, tmpdir string, conv conversion) (_ stagedConversion, err error) {
+	_, span := tracer.Start(ctx, "stage files")
+	defer func() { endSpan(span, err) }()
+
+	input := conv.inputFormat
+	format := conv.outputFormat
+
+	inputFileName := filepath.Join(tmpdir, fmt.Sprintf("%s.%s", randStringRunes(10), input.extension))
+	if err := os.WriteFile(inputFileName, conv.input, 0600); err != nil {
+		return stagedConversion{}, fmt.Errorf("could not create inputfile: %w", err)
 	}
 
 	outputDir := path.Join(tmpdir, "output")
 	if err := os.Mkdir(outputDir, 0750); err != nil {
-		return nil, fmt.Errorf("could not create output directory: %w", err)
+		return stagedConversion{}, fmt.Errorf("could not create output directory: %w", err)
 	}
-	outputFilename := filepath.Join(outputDir, fmt.Sprintf("%s.pdf", randStringRunes(10)))
+	outputFilename := filepath.Join(outputDir, fmt.Sprintf("%s.%s", randStringRunes(10), format.extension))
+	logFilename := filepath.Join(tmpdir, fmt.Sprintf("%s.json", randStringRunes(10)))
 
 	// we need to set --data-dir as you need to have a .pandoc folder in your home
 	// and we run as a different user than the docker image defaults to (which is root)
@@ -47,72 +220,187 @@ func (app *application) convert(ctx context.Context, inputFile []byte, resources
 	args := []string{
 		inputFileName,
 		fmt.Sprintf("--output=%s", outputFilename),
-		fmt.Sprintf("--data-dir=%s", app.config.PandocDataDir),
-		"--from=markdown+yaml_metadata_block+raw_html+emoji",
+		fmt.Sprintf("--data-dir=%s", c.config.PandocDataDir),
+		fmt.Sprintf("--from=%s", input.spec),
 		"--sandbox",
+		"--standalone",
+		// the log contains all warnings and errors in a machine readable format
+		fmt.Sprintf("--log=%s", logFilename),
+	}
+
+	if format.writer != "" {
+		args = append(args, fmt.Sprintf("--to=%s", format.writer))
 	}
 
 	// the pdf processor does not seem to respect the --resource-path
 	// parameter so we need to store them in the root so that referencing
 	// them works correctly
-	if len(resources) > 0 {
-		for fname, content := range resources {
-			cleaned := filepath.Clean(filepath.Join(tmpdir, fname))
-			// actual dir, check and create
-			if !strings.HasPrefix(cleaned, tmpdir) {
-				return nil, fmt.Errorf("tried to access file %s which is outside the current working directory (%s)", cleaned, tmpdir)
+	if len(conv.resources) > 0 {
+		for fname, content := range conv.resources {
+			cleaned, err := safeJoin(tmpdir, fname)
+			if err != nil {
+				return stagedConversion{}, err
 			}
 			if err := os.MkdirAll(filepath.Dir(cleaned), 0750); err != nil {
-				return nil, fmt.Errorf("could not create dir path for %s: %w", cleaned, err)
+				return stagedConversion{}, fmt.Errorf("could not create dir path for %s: %w", cleaned, err)
 			}
 			if err := os.WriteFile(cleaned, content, 0600); err != nil {
-				return nil, fmt.Errorf("could not create resource file %s: %w", cleaned, err)
+				return stagedConversion{}, fmt.Errorf("could not create resource file %s: %w", cleaned, err)
 			}
-			app.logger.Debug("created resource file", slog.String("filename", cleaned))
+			c.logger.DebugContext(ctx, "created resource file", slog.String("filename", cleaned))
 		}
 	}
 
-	if template != "" {
-		args = append(args, fmt.Sprintf("--template=%s", template))
+	switch {
+	case conv.templateContent != nil:
+		// uploaded templates are written to the working directory
+		templateFilename := filepath.Join(tmpdir, fmt.Sprintf("%s.%s", randStringRunes(10), conv.templateFormat))
+		if err := os.WriteFile(templateFilename, conv.templateContent, 0600); err != nil {
+			return stagedConversion{}, fmt.Errorf("could not create template file: %w", err)
+		}
+		args = append(args, fmt.Sprintf("--template=%s", templateFilename))
+	case conv.templateFile != "":
+		args = append(args, fmt.Sprintf("--template=%s", conv.templateFile))
+	case conv.template != "":
+		// templates pandoc resolves on its own, resources with the same
+		// name are rejected when the conversion is created
+		args = append(args, fmt.Sprintf("--template=%s", conv.template))
+	}
+
+	if conv.pdfEngine != "" {
+		args = append(args, fmt.Sprintf("--pdf-engine=%s", conv.pdfEngine))
+	}
+	for _, opt := range conv.pdfEngineOpts {
+		args = append(args, fmt.Sprintf("--pdf-engine-opt=%s", opt))
+	}
+
+	// filters are applied in the order they are specified, so the lua
+	// filters run before citeproc
+	for _, filter := range conv.luaFilters {
+		args = append(args, fmt.Sprintf("--lua-filter=%s", filter))
+	}
+
+	// bibliographies and styles are resources so they are relative to the
+	// working directory
+	if conv.citeproc {
+		args = append(args, "--citeproc")
+	}
+	for _, bibliography := range conv.bibliography {
+		args = append(args, fmt.Sprintf("--bibliography=%s", bibliography))
+	}
+	if conv.csl != "" {
+		args = append(args, fmt.Sprintf("--csl=%s", conv.csl))
+	}
+
+	if len(conv.metadata) > 0 {
+		metadata, err := yaml.Marshal(conv.metadata)
+		if err != nil {
+			return stagedConversion{}, fmt.Errorf("could not marshal metadata: %w", err)
+		}
+		metadataFilename := filepath.Join(tmpdir, fmt.Sprintf("%s.yaml", randStringRunes(10)))
+		if err := os.WriteFile(metadataFilename, metadata, 0600); err != nil {
+			return stagedConversion{}, fmt.Errorf("could not create metadata file: %w", err)
+		}
+		args = append(args, fmt.Sprintf("--metadata-file=%s", metadataFilename))
+	}
+
+	args = append(args, conv.args...)
+
+	// the defaults file is passed after the profile arguments so the values
+	// of the request take precedence
+	if conv.defaults != nil {
+		defaultsFilename := filepath.Join(tmpdir, fmt.Sprintf("%s.yaml", randStringRunes(10)))
+		if err := os.WriteFile(defaultsFilename, conv.defaults, 0600); err != nil {
+			return stagedConversion{}, fmt.Errorf("could not create defaults file: %w", err)
+		}
+		args = append(args, fmt.Sprintf("--defaults=%s", defaultsFilename))
 	}
 
-	commandCtx, cancel := context.WithTimeout(ctx, app.config.CommandTimeout)
+	return stagedConversion{
+		args:           args,
+		outputFilename: outputFilename,
+		logFilename:    logFilename,
+	}, nil
+}
+
+// run executes pandoc in the working directory
+func (c *execConverter) run(ctx context.Context, tmpdir string, staged stagedConversion) (err error) {
+	ctx, span := tracer.Start(ctx, "run pandoc")
+	defer func() { endSpan(span, err) }()
+
+	commandCtx, cancel := context.WithTimeout(ctx, c.config.CommandTimeout)
 	defer cancel()
 
-	app.logger.Debug("going to call pandoc", slog.String("args", strings.Join(args, ",")))
+	c.logger.DebugContext(ctx, "going to call pandoc", slog.String("args", strings.Join(staged.args, ",")))
+
+	name, args, err := resourceLimitCommand(c.config.PandocPath, staged.args, c.config.Limits)
+	if err != nil {
+		return fmt.Errorf("could not apply resource limits: %w", err)
+	}
 
 	var out bytes.Buffer
 	var stderr bytes.Buffer
-	cmd := exec.CommandContext(commandCtx, app.config.PandocPath, args...)
+	cmd := exec.CommandContext(commandCtx, name, args...)
 	cmd.Dir = tmpdir
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
-	if err := cmd.Run(); err != nil {
-		app.killProcessIfRunning(cmd)
-		return nil, fmt.Errorf("could not execute command %w: %s", err, stderr.String())
+	setupProcessGroup(cmd, c.config.CommandKillGracePeriod)
+	// make sure no child processes are left behind
+	defer c.killProcessGroup(ctx, cmd)
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("could not start command: %w", err)
+	}
+	err = cmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// pandoc exited successfully but a child process kept stdout or
+		// stderr open. The leftover children are killed with the process
+		// group so the conversion is fine.
+		c.logger.WarnContext(ctx, "pandoc child process kept the output open", slog.String("err", err.Error()))
+		err = nil
 	}
-
-	app.logger.Debug("STDOUT", slog.String("out", out.String()))
-	app.logger.Debug("STDERR", slog.String("out", stderr.String()))
-
-	app.killProcessIfRunning(cmd)
-
-	content, err := os.ReadFile(outputFilename)
 	if err != nil {
-		return nil, fmt.Errorf("could not read output file: %w", err)
+		diagnostics := append(c.readLog(ctx, staged.logFilename), parseLatexErrors(stderr.String())...)
+		if limitErr := checkResourceLimits(c.config.Limits, err, stderr.String()); limitErr != nil {
+			return &diagnosticsError{err: limitErr, diagnostics: diagnostics}
+		}
+		if ctxErr := commandCtx.Err(); ctxErr != nil {
+			if errors.Is(ctxErr, context.DeadlineExceeded) {
+				ctxErr = errConversionTimeout
+			}
+			err = fmt.Errorf("%w: %w", ctxErr, err)
+		}
+		return &diagnosticsError{
+			err:         fmt.Errorf("could not execute command %w: %s", err, stderr.String()),
+			diagnostics: diagnostics,
+		}
 	}
 
-	return content, nil
+	c.logger.DebugContext(ctx, "STDOUT", slog.String("out", out.String()))
+	c.logger.DebugContext(ctx, "STDERR", slog.String("out", stderr.String()))
+
+	return nil
 }
 
-func (app *application) killProcessIfRunning(cmd *exec.Cmd) {
-	if cmd.Process == nil {
-		return
+// readLog returns the diagnostics from the pandoc log file. Errors are only
+// logged as the log is not needed for the conversion.
+func (c *execConverter) readLog(ctx context.Context, filename string) []diagnostic {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		// pandoc does not write the log if it fails early
+		if !errors.Is(err, os.ErrNotExist) {
+			c.logger.ErrorContext(ctx, "could not read pandoc log", slog.String("err", err.Error()))
+		}
+		return nil
 	}
-	if err := cmd.Process.Release(); err != nil {
-		return
+	diagnostics, err := parsePandocLog(content)
+	if err != nil {
+		c.logger.ErrorContext(ctx, "could not parse pandoc log", slog.String("err", err.Error()))
 	}
-	if err := cmd.Process.Kill(); err != nil {
-		return
+	return diagnostics
+}
+
+func (c *execConverter) killProcessGroup(ctx context.Context, cmd *exec.Cmd) {
+	if err := killProcessGroup(cmd); err != nil {
+		c.logger.ErrorContext(ctx, "could not kill process group", slog.String("err", err.Error()))
 	}
 }
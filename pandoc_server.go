@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// binaryInputFormats need to be base64 encoded when sent to pandoc-server
+var binaryInputFormats = map[string]bool{
+	"docx": true,
+	"odt":  true,
+	"epub": true,
+	"pptx": true,
+	"xlsx": true,
+}
+
+// pandocServerConverter forwards conversions to a pandoc instance running in
+// server mode (pandoc-server or pandoc --server)
+type pandocServerConverter struct {
+	logger  *slog.Logger
+	client  *http.Client
+	url     string
+	healthy atomic.Bool
+}
+
+func newPandocServerConverter(configuration config.Configuration, logger *slog.Logger) *pandocServerConverter {
+	return &pandocServerConverter{
+		logger: logger,
+		client: &http.Client{Timeout: configuration.CommandTimeout},
+		url:    strings.TrimSuffix(configuration.PandocServer.URL, "/"),
+	}
+}
+
+// supports returns true if pandoc-server is able to handle the conversion
+func (c *pandocServerConverter) supports(conv conversion) bool {
+	// pandoc-server can not create pdfs and does not accept command line
+	// arguments, metadata or defaults files. Citations and filters are also
+	// handled by the exec backend.
+	if conv.outputFormat.writer == "" || len(conv.args) > 0 || len(conv.metadata) > 0 || conv.defaults != nil || conv.citeproc || len(conv.luaFilters) > 0 {
+		return false
+	}
+	// pandoc-server expects the content of the template, templates pandoc
+	// resolves on its own need the exec backend
+	return conv.template == "" || conv.templateContent != nil || conv.templateFile != ""
+}
+
+func (c *pandocServerConverter) isHealthy() bool {
+	return c.healthy.Load()
+}
+
+// checkHealth queries the version endpoint of pandoc-server
+func (c *pandocServerConverter) checkHealth(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url+"/version", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	version, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("version endpoint returned status %d", resp.StatusCode)
+	}
+	c.logger.DebugContext(ctx, "pandoc-server is healthy", slog.String("version", strings.TrimSpace(string(version))))
+	return nil
+}
+
+// healthLoop checks the health of pandoc-server in the given interval until
+// ctx is done
+func (c *pandocServerConverter) healthLoop(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for first := true; ; first = false {
+		checkCtx, cancel := context.WithTimeout(ctx, interval)
+		err := c.checkHealth(checkCtx)
+		cancel()
+		wasHealthy := c.healthy.Swap(err == nil)
+		// only log state changes
+		switch {
+		case err != nil && (wasHealthy || first):
+			c.logger.ErrorContext(ctx, "pandoc-server is unhealthy", slog.String("url", c.url), slog.String("err", err.Error()))
+		case err == nil && !wasHealthy:
+			c.logger.InfoContext(ctx, "pandoc-server is healthy", slog.String("url", c.url))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *pandocServerConverter) convert(ctx context.Context, conv conversion) (_ conversionResult, err error) {
+	ctx, span := tracer.Start(ctx, "call pandoc-server", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { endSpan(span, err) }()
+
+	type pandocServerRequest struct {
+		Text       string            `json:"text"`
+		From       string            `json:"from"`
+		To         string            `json:"to"`
+		Standalone bool              `json:"standalone"`
+		Template   string            `json:"template,omitempty"`
+		Files      map[string]string `json:"files,omitempty"`
+	}
+	type pandocServerResponse struct {
+		Output   string          `json:"output"`
+		Base64   bool            `json:"base64"`
+		Messages json.RawMessage `json:"messages"`
+	}
+
+	payload := pandocServerRequest{
+		Text:       string(conv.input),
+		From:       conv.inputFormat.spec,
+		To:         conv.outputFormat.writer,
+		Standalone: true,
+		Files:      make(map[string]string, len(conv.resources)),
+	}
+	if binaryInputFormats[conv.inputFormat.reader] {
+		payload.Text = base64.StdEncoding.EncodeToString(conv.input)
+	}
+	for name, content := range conv.resources {
+		payload.Files[name] = base64.StdEncoding.EncodeToString(content)
+	}
+	switch {
+	case conv.templateContent != nil:
+		payload.Template = string(conv.templateContent)
+	case conv.templateFile != "":
+		template, err := os.ReadFile(conv.templateFile)
+		if err != nil {
+			return conversionResult{}, fmt.Errorf("could not read template %q: %w", conv.template, err)
+		}
+		payload.Template = string(template)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return conversionResult{}, fmt.Errorf("could not marshal pandoc-server request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/", bytes.NewReader(body))
+	if err != nil {
+		return conversionResult{}, fmt.Errorf("could not create pandoc-server request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(requestIDHeaderName, requestID)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	c.logger.DebugContext(ctx, "going to call pandoc-server", slog.String("url", c.url), slog.String("from", payload.From), slog.String("to", payload.To))
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return conversionResult{}, fmt.Errorf("%w: could not call pandoc-server: %w", errConversionTimeout, err)
+		}
+		return conversionResult{}, fmt.Errorf("could not call pandoc-server: %w", err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return conversionResult{}, fmt.Errorf("could not read pandoc-server response: %w", err)
+	}
+	// pandoc-server returns the error message as plain text
+	if resp.StatusCode != http.StatusOK {
+		return conversionResult{}, fmt.Errorf("pandoc-server returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var r pandocServerResponse
+	if err := json.Unmarshal(respBody, &r); err != nil {
+		return conversionResult{}, fmt.Errorf("could not parse pandoc-server response: %w", err)
+	}
+
+	// the messages use the same format as the pandoc log
+	diagnostics, err := parsePandocLog(r.Messages)
+	if err != nil {
+		c.logger.ErrorContext(ctx, "could not parse pandoc-server messages", slog.String("err", err.Error()))
+	}
+
+	if !r.Base64 {
+		return conversionResult{content: []byte(r.Output), diagnostics: diagnostics}, nil
+	}
+	content, err := base64.StdEncoding.DecodeString(r.Output)
+	if err != nil {
+		return conversionResult{}, fmt.Errorf("could not decode pandoc-server output: %w", err)
+	}
+	return conversionResult{content: content, diagnostics: diagnostics}, nil
+}
+
+// routingConverter sends all conversions pandoc-server supports to the
+// pandoc-server backend as long as it's healthy and uses the exec backend
+// for everything else
+type routingConverter struct {
+	exec         converter
+	pandocServer *pandocServerConverter
+}
+
+func (c *routingConverter) convert(ctx context.Context, conv conversion) (conversionResult, error) {
+	if c.pandocServer.supports(conv) && c.pandocServer.isHealthy() {
+		return c.pandocServer.convert(ctx, conv)
+	}
+	return c.exec.convert(ctx, conv)
+}
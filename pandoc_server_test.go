@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// stubPandocServer emulates the API of pandoc-server
+type stubPandocServer struct {
+	*httptest.Server
+	up atomic.Bool
+
+	mu       sync.Mutex
+	requests []map[string]any
+	headers  []http.Header
+}
+
+func newStubPandocServer(t *testing.T) *stubPandocServer {
+	t.Helper()
+	s := &stubPandocServer{}
+	s.up.Store(true)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /version", func(w http.ResponseWriter, r *http.Request) {
+		if !s.up.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = io.WriteString(w, "3.1.11\n")
+	})
+	mux.HandleFunc("POST /{$}", func(w http.ResponseWriter, r *http.Request) {
+		var payload map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.requests = append(s.requests, payload)
+		s.headers = append(s.headers, r.Header.Clone())
+		s.mu.Unlock()
+
+		// binary formats are returned base64 encoded
+		resp := map[string]any{
+			"output":   "<p>converted</p>",
+			"base64":   false,
+			"messages": []map[string]any{{"type": "NoTitleElement", "verbosity": "WARNING", "fallback": "doc"}},
+		}
+		if payload["to"] == "docx" {
+			resp["output"] = base64.StdEncoding.EncodeToString([]byte("PK\x03\x04binary"))
+			resp["base64"] = true
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *stubPandocServer) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+func newTestPandocServerConverter(url string) *pandocServerConverter {
+	return newPandocServerConverter(config.Configuration{
+		CommandTimeout: 5 * time.Second,
+		PandocServer:   config.ConfigPandocServer{URL: url},
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func testConversion(t *testing.T, from, to string) conversion {
+	t.Helper()
+	input, err := getInputFormat(from, []string{from})
+	if err != nil {
+		t.Fatal(err)
+	}
+	output, err := getOutputFormat(to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conversion{
+		input:        []byte("# Hello"),
+		inputFormat:  input,
+		outputFormat: output,
+	}
+}
+
+func waitForHealth(t *testing.T, c *pandocServerConverter, healthy bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.isHealthy() != healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("pandoc-server did not become healthy=%t", healthy)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestPandocServerHealthLoop(t *testing.T) {
+	stub := newStubPandocServer(t)
+	c := newTestPandocServerConverter(stub.URL)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.healthLoop(ctx, 10*time.Millisecond)
+
+	waitForHealth(t, c, true)
+	stub.up.Store(false)
+	waitForHealth(t, c, false)
+	stub.up.Store(true)
+	waitForHealth(t, c, true)
+}
+
+func TestPandocServerUnreachable(t *testing.T) {
+	stub := newStubPandocServer(t)
+	url := stub.URL
+	stub.Close()
+
+	c := newTestPandocServerConverter(url)
+	if err := c.checkHealth(context.Background()); err == nil {
+		t.Fatal("expected an error for an unreachable pandoc-server")
+	}
+}
+
+func TestRoutingConverterFallsBackToExec(t *testing.T) {
+	stub := newStubPandocServer(t)
+	execBackend := &fakeConverter{}
+	c := &routingConverter{
+		exec:         execBackend,
+		pandocServer: newTestPandocServerConverter(stub.URL),
+	}
+	supported := testConversion(t, "markdown", "html")
+
+	// the health check did not run yet
+	if _, err := c.convert(context.Background(), supported); err != nil {
+		t.Fatal(err)
+	}
+	if stub.calls() != 0 || len(execBackend.calls()) != 1 {
+		t.Fatalf("unhealthy pandoc-server: expected the exec backend, got %d pandoc-server and %d exec calls", stub.calls(), len(execBackend.calls()))
+	}
+
+	c.pandocServer.healthy.Store(true)
+	result, err := c.convert(context.Background(), supported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stub.calls() != 1 || len(execBackend.calls()) != 1 {
+		t.Fatalf("healthy pandoc-server: expected pandoc-server, got %d pandoc-server and %d exec calls", stub.calls(), len(execBackend.calls()))
+	}
+	if string(result.content) != "<p>converted</p>" {
+		t.Errorf("unexpected content %q", result.content)
+	}
+	if len(result.diagnostics) != 1 || result.diagnostics[0].Type != "NoTitleElement" {
+		t.Errorf("unexpected diagnostics %+v", result.diagnostics)
+	}
+
+	// pandoc-server can not handle pdfs, metadata or profile arguments
+	pdf := testConversion(t, "markdown", "pdf")
+	withMetadata := supported
+	withMetadata.metadata = map[string]any{"title": "x"}
+	withArgs := supported
+	withArgs.args = []string{"--toc"}
+	for _, conv := range []conversion{pdf, withMetadata, withArgs} {
+		if _, err := c.convert(context.Background(), conv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.calls() != 1 || len(execBackend.calls()) != 4 {
+		t.Fatalf("unsupported conversions: expected the exec backend, got %d pandoc-server and %d exec calls", stub.calls(), len(execBackend.calls()))
+	}
+}
+
+func TestPandocServerConvertBase64(t *testing.T) {
+	stub := newStubPandocServer(t)
+	c := newTestPandocServerConverter(stub.URL)
+
+	conv := testConversion(t, "docx", "docx")
+	conv.input = []byte("PK\x03\x04input")
+	conv.resources = map[string][]byte{"images/a.png": []byte("png")}
+	result, err := c.convert(withRequestID(context.Background(), "req-1"), conv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(result.content) != "PK\x03\x04binary" {
+		t.Errorf("base64 output was not decoded: %q", result.content)
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	req := stub.requests[0]
+	// binary input and all files are sent base64 encoded
+	if req["text"] != base64.StdEncoding.EncodeToString(conv.input) {
+		t.Errorf("binary input was not base64 encoded: %v", req["text"])
+	}
+	files, _ := req["files"].(map[string]any)
+	if files["images/a.png"] != base64.StdEncoding.EncodeToString([]byte("png")) {
+		t.Errorf("unexpected files %v", req["files"])
+	}
+	if got := stub.headers[0].Get(requestIDHeaderName); got != "req-1" {
+		t.Errorf("expected request id header req-1, got %q", got)
+	}
+}
+
+func TestPandocServerTemplates(t *testing.T) {
+	stub := newStubPandocServer(t)
+	execBackend := &fakeConverter{}
+	c := &routingConverter{
+		exec:         execBackend,
+		pandocServer: newTestPandocServerConverter(stub.URL),
+	}
+	c.pandocServer.healthy.Store(true)
+
+	// templates pandoc resolves on its own can only be used by the exec backend
+	resolvedByPandoc := testConversion(t, "markdown", "html")
+	resolvedByPandoc.template = "default"
+	if _, err := c.convert(context.Background(), resolvedByPandoc); err != nil {
+		t.Fatal(err)
+	}
+	if stub.calls() != 0 || len(execBackend.calls()) != 1 {
+		t.Fatalf("expected the exec backend, got %d pandoc-server and %d exec calls", stub.calls(), len(execBackend.calls()))
+	}
+
+	// builtin templates are read from the resolved path
+	templateFile := filepath.Join(t.TempDir(), "report.html")
+	if err := os.WriteFile(templateFile, []byte("<main>$body$</main>"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	builtin := testConversion(t, "markdown", "html")
+	builtin.template = "report"
+	builtin.templateFile = templateFile
+	uploaded := testConversion(t, "markdown", "html")
+	uploaded.template = "corporate"
+	uploaded.templateContent = []byte("<div>$body$</div>")
+	for _, conv := range []conversion{builtin, uploaded} {
+		if _, err := c.convert(context.Background(), conv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if stub.calls() != 2 || len(execBackend.calls()) != 1 {
+		t.Fatalf("expected pandoc-server, got %d pandoc-server and %d exec calls", stub.calls(), len(execBackend.calls()))
+	}
+
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if got := stub.requests[0]["template"]; got != "<main>$body$</main>" {
+		t.Errorf("unexpected builtin template %q", got)
+	}
+	if got := stub.requests[1]["template"]; got != "<div>$body$</div>" {
+		t.Errorf("unexpected uploaded template %q", got)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var errInvalidPDFEngine = errors.New("invalid pdf engine")
+
+// pdfWriter returns the pandoc writer used to create a pdf with the engine
+func pdfWriter(engine string) string {
+	switch engine {
+	case "typst":
+		return "typst"
+	case "context":
+		return "context"
+	case "wkhtmltopdf", "weasyprint", "pagedjs-cli", "prince":
+		return "html"
+	default:
+		return "latex"
+	}
+}
+
+// getPDFEngine checks the requested engine against the allowed engines
+func getPDFEngine(engine string, allowed []string) (string, error) {
+	if !slices.Contains(allowed, engine) {
+		return "", fmt.Errorf("%w %q, allowed engines: %s", errInvalidPDFEngine, engine, strings.Join(allowed, ", "))
+	}
+	return engine, nil
+}
+
+// validatePDFEngineOpts makes sure all options are in the list of options
+// the operator allowed for the engine. Options are compared as is, so an
+// option with a value needs to be allowed including the value.
+func validatePDFEngineOpts(engine string, opts []string, allowed map[string][]string) error {
+	for _, opt := range opts {
+		if !slices.Contains(allowed[engine], opt) {
+			return fmt.Errorf("pdf engine option %q is not allowed for engine %q", opt, engine)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errQueueFull    = errors.New("conversion queue is full")
+	errQueueTimeout = errors.New("timed out waiting for a free conversion worker")
+)
+
+// workerPool limits the number of concurrently running pandoc processes.
+// Requests that can not be served right away wait in a bounded queue.
+type workerPool struct {
+	slots     chan struct{}
+	queueSize int
+	queued    atomic.Int64
+}
+
+func newWorkerPool(workers, queueSize int) *workerPool {
+	return &workerPool{
+		slots:     make(chan struct{}, workers),
+		queueSize: queueSize,
+	}
+}
+
+// acquire blocks until a worker is available and returns a function to
+// release it again. If the queue is full errQueueFull is returned, if no
+// worker gets available within maxWait errQueueTimeout is returned.
+// A maxWait of 0 waits until ctx is done.
+func (p *workerPool) acquire(ctx context.Context, maxWait time.Duration) (func(), error) {
+	release := func() { <-p.slots }
+
+	// fast path if there is a free worker
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+
+	if p.queued.Add(1) > int64(p.queueSize) {
+		p.queued.Add(-1)
+		metricQueueRejections.WithLabelValues("full").Inc()
+		return nil, errQueueFull
+	}
+	defer p.queued.Add(-1)
+
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+		return release, nil
+	case <-timeout:
+		metricQueueRejections.WithLabelValues("timeout").Inc()
+		return nil, errQueueTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// wait blocks until a worker is available or ctx is done and returns a
+// function to release the worker again. It does not use the request queue, it
+// is used by jobs which are limited by their own queue.
+func (p *workerPool) wait(ctx context.Context) (func(), error) {
+	select {
+	case p.slots <- struct{}{}:
+		return func() { <-p.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// active returns the number of busy workers
+func (p *workerPool) active() int {
+	return len(p.slots)
+}
+
+// workers returns the maximum number of concurrent workers
+func (p *workerPool) workers() int {
+	return cap(p.slots)
+}
+
+// queueDepth returns the number of requests waiting for a worker
+func (p *workerPool) queueDepth() int {
+	return int(p.queued.Load())
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"time"
+)
+
+// setupProcessGroup only kills the main process on non unix systems as there
+// are no process groups
+func setupProcessGroup(cmd *exec.Cmd, gracePeriod time.Duration) {
+	cmd.WaitDelay = gracePeriod
+}
+
+// killProcessGroup is a noop on non unix systems
+func killProcessGroup(_ *exec.Cmd) error {
+	return nil
+}
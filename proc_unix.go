@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// setupProcessGroup starts the command in its own process group so we can
+// signal pandoc and all of its children (pdflatex, rsvg-convert, ...) at
+// once. When the context of the command is cancelled the whole group
+// receives a SIGTERM, if it's still running after gracePeriod pandoc gets
+// killed. Call killProcessGroup after the command finished to kill any
+// leftover children.
+func setupProcessGroup(cmd *exec.Cmd, gracePeriod time.Duration) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return signalProcessGroup(cmd, syscall.SIGTERM)
+	}
+	cmd.WaitDelay = gracePeriod
+}
+
+// killProcessGroup sends a SIGKILL to the process group of the command
+func killProcessGroup(cmd *exec.Cmd) error {
+	return signalProcessGroup(cmd, syscall.SIGKILL)
+}
+
+func signalProcessGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if cmd.Process == nil {
+		return nil
+	}
+	// a negative pid signals the whole process group
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return err
+	}
+	return nil
+}
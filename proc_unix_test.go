@@ -0,0 +1,127 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// writeStubPandoc writes a shell script used as the pandoc binary
+func writeStubPandoc(t *testing.T, script string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "pandoc")
+	if err := os.WriteFile(filename, []byte("#!/bin/sh\n"+script), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func testExecConverter(pandocPath string) *execConverter {
+	return newExecConverter(config.Configuration{
+		PandocPath:             pandocPath,
+		CommandTimeout:         10 * time.Second,
+		CommandKillGracePeriod: 200 * time.Millisecond,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// readPID waits until the stub pandoc wrote the pid of its child
+func readPID(t *testing.T, filename string) int {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		content, err := os.ReadFile(filename)
+		if err == nil && strings.HasSuffix(string(content), "\n") {
+			pid, err := strconv.Atoi(strings.TrimSpace(string(content)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return pid
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("stub pandoc did not start its child process")
+	return 0
+}
+
+// processGone returns true if the process does not exist anymore or is a
+// zombie waiting to be reaped by init
+func processGone(pid int) bool {
+	if err := syscall.Kill(pid, 0); errors.Is(err, syscall.ESRCH) {
+		return true
+	}
+	stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return errors.Is(err, os.ErrNotExist)
+	}
+	// the state follows the command name in parentheses
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] == "Z"
+}
+
+func waitForProcessGone(t *testing.T, pid int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if processGone(pid) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	_ = syscall.Kill(pid, syscall.SIGKILL)
+	t.Fatalf("child process %d is still running", pid)
+}
+
+func TestRunKillsChildrenOnCancel(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	pandoc := writeStubPandoc(t, `sleep 60 &
+echo $! > "`+pidFile+`"
+wait
+`)
+	c := testExecConverter(pandoc)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- c.run(ctx, t.TempDir(), stagedConversion{})
+	}()
+
+	pid := readPID(t, pidFile)
+	cancel()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("expected context.Canceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("run did not return after cancelling the context")
+	}
+	waitForProcessGone(t, pid)
+}
+
+func TestRunIgnoresChildrenKeepingOutputOpen(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	// the child inherits stdout and stderr and outlives pandoc
+	pandoc := writeStubPandoc(t, `sleep 60 &
+echo $! > "`+pidFile+`"
+exit 0
+`)
+	c := testExecConverter(pandoc)
+
+	if err := c.run(context.Background(), t.TempDir(), stagedConversion{}); err != nil {
+		t.Fatalf("successful conversion reported an error: %v", err)
+	}
+	waitForProcessGone(t, readPID(t, pidFile))
+}
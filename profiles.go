@@ -0,0 +1,50 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// profile bundles a template with default metadata, pandoc arguments and
+// resources so clients only need to reference it by name
+type profile struct {
+	template  string
+	pdfEngine string
+	metadata  map[string]any
+	args      []string
+	resources map[string][]byte
+}
+
+// loadProfiles reads the profiles from the config including the content of
+// all resource files
+func loadProfiles(profiles map[string]config.ConfigProfile) (map[string]profile, error) {
+	ret := make(map[string]profile, len(profiles))
+	for name, p := range profiles {
+		resources := make(map[string][]byte, len(p.Resources))
+		for _, resource := range p.Resources {
+			content, err := os.ReadFile(resource.Path)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: could not read resource %q: %w", name, resource.Path, err)
+			}
+			resources[resource.Name] = content
+		}
+
+		ret[name] = profile{
+			template:  p.Template,
+			pdfEngine: p.PDFEngine,
+			metadata:  p.Metadata,
+			args:      p.Args,
+			resources: resources,
+		}
+	}
+	return ret, nil
+}
+
+// profileNames returns the sorted names of all profiles
+func profileNames(profiles map[string]profile) []string {
+	return slices.Sorted(maps.Keys(profiles))
+}
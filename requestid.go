@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"regexp"
+
+	"github.com/labstack/echo/v5"
+)
+
+// requestIDRegex limits the request ids accepted from clients so they can be
+// safely written to logs and notifications
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+type requestIDContextKey struct{}
+
+// withRequestID returns a copy of ctx holding the request id
+func withRequestID(ctx context.Context, requestID string) context.Context {
+	if requestID == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, requestIDContextKey{}, requestID)
+}
+
+// requestIDFromContext returns the request id stored in ctx or an empty string
+func requestIDFromContext(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDContextKey{}).(string)
+	return requestID
+}
+
+// middlewareRequestID takes the request id from the X-Request-ID header or
+// generates a new one if the header is missing or invalid. The id is sent back
+// in the response header and stored in the request context so it is added to
+// all log records of the request.
+func (app *application) middlewareRequestID() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			requestID := req.Header.Get(requestIDHeaderName)
+			if !requestIDRegex.MatchString(requestID) {
+				requestID = rand.Text()
+			}
+			c.Response().Header().Set(requestIDHeaderName, requestID)
+			c.SetRequest(req.WithContext(withRequestID(req.Context(), requestID)))
+			return next(c)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"golang.org/x/sys/unix"
+)
+
+// resourceLimitHelperArg is the first argument when the server binary is run
+// as the resource limit helper
+const resourceLimitHelperArg = "__exec-with-resource-limits"
+
+// resourceLimitCommand returns the command to run pandoc with the configured
+// rlimits. If limits are enabled the server binary is started as a helper
+// which sets the limits on itself and then replaces itself with pandoc, so
+// the limits are in place before pandoc runs. Child processes inherit the
+// limits, so they also apply to the LaTeX engines spawned by pandoc.
+func resourceLimitCommand(pandocPath string, args []string, limits config.ConfigLimits) (string, []string, error) {
+	if !resourceLimitsEnabled(limits) {
+		return pandocPath, args, nil
+	}
+	self, err := os.Executable()
+	if err != nil {
+		return "", nil, fmt.Errorf("could not determine the path of the server binary: %w", err)
+	}
+	helperArgs := []string{
+		resourceLimitHelperArg,
+		strconv.FormatUint(limits.AddressSpace, 10),
+		strconv.FormatUint(uint64(math.Ceil(limits.CPUTime.Seconds())), 10),
+		strconv.FormatUint(limits.FileSize, 10),
+		strconv.FormatUint(limits.OpenFiles, 10),
+		strconv.FormatUint(limits.Processes, 10),
+		pandocPath,
+	}
+	return self, append(helperArgs, args...), nil
+}
+
+// runResourceLimitHelper sets the rlimits passed by resourceLimitCommand and
+// executes pandoc. It only returns on errors.
+func runResourceLimitHelper(args []string) error {
+	if len(args) < 6 {
+		return errors.New("invalid arguments")
+	}
+	var values [5]uint64
+	for i := range values {
+		v, err := strconv.ParseUint(args[i], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid limit %q: %w", args[i], err)
+		}
+		values[i] = v
+	}
+	addressSpace, cpuTime, fileSize, openFiles, processes := values[0], values[1], values[2], values[3], values[4]
+
+	if addressSpace > 0 {
+		if err := setRlimit(unix.RLIMIT_AS, addressSpace, addressSpace); err != nil {
+			return fmt.Errorf("address space: %w", err)
+		}
+	}
+	if cpuTime > 0 {
+		// the soft limit sends a SIGXCPU, the hard limit a SIGKILL
+		if err := setRlimit(unix.RLIMIT_CPU, cpuTime, cpuTime+1); err != nil {
+			return fmt.Errorf("cpu time: %w", err)
+		}
+	}
+	if fileSize > 0 {
+		if err := setRlimit(unix.RLIMIT_FSIZE, fileSize, fileSize); err != nil {
+			return fmt.Errorf("file size: %w", err)
+		}
+	}
+	if openFiles > 0 {
+		if err := setRlimit(unix.RLIMIT_NOFILE, openFiles, openFiles); err != nil {
+			return fmt.Errorf("open files: %w", err)
+		}
+	}
+	// RLIMIT_NPROC counts all processes of the user and not only the ones
+	// spawned by pandoc
+	if processes > 0 {
+		if err := setRlimit(unix.RLIMIT_NPROC, processes, processes); err != nil {
+			return fmt.Errorf("processes: %w", err)
+		}
+	}
+
+	pandocPath, err := exec.LookPath(args[5])
+	if err != nil {
+		return err
+	}
+	argv := append([]string{args[5]}, args[6:]...)
+	return unix.Exec(pandocPath, argv, os.Environ())
+}
+
+// setRlimit sets the limit. Unprivileged processes can not raise the hard
+// limit, so limits above the current hard limit are lowered to it.
+func setRlimit(resource int, soft, hard uint64) error {
+	var current unix.Rlimit
+	if err := unix.Getrlimit(resource, &current); err != nil {
+		return err
+	}
+	hard = min(hard, current.Max)
+	soft = min(soft, hard)
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: soft, Max: hard})
+}
+
+// limitFromExitError checks if the process was killed by a signal caused by
+// one of the resource limits
+func limitFromExitError(limits config.ConfigLimits, exitErr *exec.ExitError) string {
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	if !ok || !status.Signaled() {
+		return ""
+	}
+	switch status.Signal() {
+	case syscall.SIGXCPU:
+		return limitCPUTime
+	case syscall.SIGXFSZ:
+		return limitFileSize
+	case syscall.SIGKILL:
+		// the hard cpu limit kills the process
+		if limits.CPUTime > 0 && exitErr.UserTime()+exitErr.SystemTime() >= limits.CPUTime {
+			return limitCPUTime
+		}
+	}
+	return ""
+}
@@ -0,0 +1,145 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// TestMain runs the resource limit helper when the test binary is started
+// as the helper by resourceLimitCommand
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == resourceLimitHelperArg {
+		if err := runResourceLimitHelper(os.Args[2:]); err != nil {
+			os.Stderr.WriteString(err.Error())
+		}
+		os.Exit(126)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunAppliesResourceLimitsBeforeExec(t *testing.T) {
+	limitsFile := filepath.Join(t.TempDir(), "limits")
+	// cat is a child of the stub so this also checks the limits are inherited
+	pandoc := writeStubPandoc(t, `cat /proc/self/limits > "`+limitsFile+`"`)
+	c := testExecConverter(pandoc)
+	c.config.Limits = config.ConfigLimits{
+		CPUTime:   7 * time.Second,
+		FileSize:  1 << 20,
+		OpenFiles: 64,
+	}
+
+	if err := c.run(context.Background(), t.TempDir(), stagedConversion{}); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(limitsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limits := make(map[string][]string)
+	for line := range strings.Lines(string(content)) {
+		// the name is separated from the values by at least two spaces
+		name, values, ok := strings.Cut(line, "  ")
+		if ok {
+			limits[name] = strings.Fields(values)
+		}
+	}
+	for name, want := range map[string][]string{
+		"Max cpu time":   {"7", "8"},
+		"Max file size":  {"1048576", "1048576"},
+		"Max open files": {"64", "64"},
+	} {
+		got := limits[name]
+		if len(got) < 2 || got[0] != want[0] || got[1] != want[1] {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestRunReportsCPUTimeLimit(t *testing.T) {
+	pandoc := writeStubPandoc(t, "while :; do :; done\n")
+	c := testExecConverter(pandoc)
+	c.config.Limits = config.ConfigLimits{CPUTime: 1 * time.Second}
+
+	err := c.run(context.Background(), t.TempDir(), stagedConversion{})
+	limitErr, ok := errors.AsType[*resourceLimitError](err)
+	if !ok {
+		t.Fatalf("expected a resource limit error, got %v", err)
+	}
+	if limitErr.limit != limitCPUTime {
+		t.Errorf("expected limit %q, got %q", limitCPUTime, limitErr.limit)
+	}
+}
+
+// exitError runs the shell script and returns its exit error
+func exitError(t *testing.T, script string) error {
+	t.Helper()
+	err := exec.Command("/bin/sh", "-c", script).Run()
+	if _, ok := errors.AsType[*exec.ExitError](err); !ok {
+		t.Fatalf("expected an exit error, got %v", err)
+	}
+	return err
+}
+
+func TestCheckResourceLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits config.ConfigLimits
+		script string
+		stderr string
+		want   string
+	}{
+		{
+			name:   "stderr hint of a configured limit",
+			limits: config.ConfigLimits{Processes: 10},
+			script: "exit 1",
+			stderr: "fork: Resource temporarily unavailable",
+			want:   limitProcesses,
+		},
+		{
+			name:   "stderr hint of a limit that is not configured",
+			limits: config.ConfigLimits{CPUTime: time.Minute},
+			script: "exit 1",
+			stderr: "fork: Resource temporarily unavailable",
+		},
+		{
+			name:   "signal of a configured limit",
+			limits: config.ConfigLimits{FileSize: 1 << 20},
+			script: "kill -XFSZ $$",
+			want:   limitFileSize,
+		},
+		{
+			name:   "signal of a limit that is not configured",
+			limits: config.ConfigLimits{CPUTime: time.Minute},
+			script: "kill -XFSZ $$",
+		},
+		{
+			name:   "signal is preferred over stderr",
+			limits: config.ConfigLimits{AddressSpace: 1 << 30},
+			script: "kill -KILL $$",
+			stderr: "out of memory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkResourceLimits(tt.limits, exitError(t, tt.script), tt.stderr)
+			limitErr, ok := errors.AsType[*resourceLimitError](err)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("expected no resource limit error, got %v", err)
+			case tt.want != "" && (!ok || limitErr.limit != tt.want):
+				t.Errorf("expected limit %q, got %v", tt.want, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,32 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+// resourceLimitHelperArg is the first argument when the server binary is run
+// as the resource limit helper
+const resourceLimitHelperArg = "__exec-with-resource-limits"
+
+// resourceLimitCommand is only supported on linux
+func resourceLimitCommand(pandocPath string, args []string, limits config.ConfigLimits) (string, []string, error) {
+	if resourceLimitsEnabled(limits) {
+		return "", nil, fmt.Errorf("resource limits are only supported on linux")
+	}
+	return pandocPath, args, nil
+}
+
+// runResourceLimitHelper is only supported on linux
+func runResourceLimitHelper(_ []string) error {
+	return fmt.Errorf("resource limits are only supported on linux")
+}
+
+// limitFromExitError is only supported on linux
+func limitFromExitError(_ config.ConfigLimits, _ *exec.ExitError) string {
+	return ""
+}
@@ -1,41 +1,31 @@
 package main
 
 import (
-	"log/slog"
-	"net/http"
-
 	"github.com/labstack/echo/v5"
 )
 
 func (app *application) addRoutes(e *echo.Echo) {
 	e.GET("/health", app.handleHealth)
+	e.GET("/status", app.handleStatus)
 	e.GET("/test_panic", app.handleTestPanic)
 	e.GET("/test_notifications", app.handleTestNotification)
-	e.POST("/convert", func(c *echo.Context) error {
-		type jsonData struct {
-			Input     []byte            `json:"input"`
-			Resources map[string][]byte `json:"resources"`
-			Template  string            `json:"template"`
-		}
-		type jsonResponse struct {
-			Content []byte `json:"content"`
-		}
-
-		var d jsonData
-		if err := c.Bind(&d); err != nil {
-			return c.JSON(http.StatusBadRequest, newEchoJsonError(err, http.StatusBadRequest, "invalid input"))
-		}
-
-		if d.Input == nil || d.Template == "" {
-			return c.JSON(http.StatusBadRequest, echo.NewHTTPError(http.StatusBadRequest, "invalid input"))
-		}
+	e.POST("/convert", app.handleConvert, app.middlewareScope(scopeConvert))
+	e.POST("/jobs", app.handleJobCreate, app.middlewareScope(scopeConvert))
+	e.GET("/jobs/:id", app.handleJobStatus, app.middlewareScope(scopeJobsRead))
+	e.GET("/jobs/:id/result", app.handleJobResult, app.middlewareScope(scopeJobsRead))
+	e.DELETE("/jobs/:id", app.handleJobDelete, app.middlewareScope(scopeConvert))
 
-		bin, err := app.convert(c.Request().Context(), d.Input, d.Resources, d.Template)
-		if err != nil {
-			app.logger.Error("error on convert", slog.String("error", err.Error()))
-			return c.JSON(http.StatusBadRequest, newEchoJsonError(err, http.StatusBadRequest, "error converting markdown"))
-		}
+	// clients converting documents can see the templates and styles they
+	// can use, changing them needs the templates:write scope
+	templatesRead := app.middlewareSecretKeyOrScope(scopeConvert)
+	templatesWrite := app.middlewareSecretKeyOrScope(scopeTemplatesWrite)
+	e.GET("/templates", app.handleTemplateList, templatesRead)
+	e.GET("/templates/:name", app.handleTemplateGet, templatesRead)
+	e.PUT("/templates/:name", app.handleTemplateUpload, templatesWrite)
+	e.DELETE("/templates/:name", app.handleTemplateDelete, templatesWrite)
 
-		return c.JSON(http.StatusOK, jsonResponse{Content: bin})
-	})
+	e.GET("/styles", app.handleStyleList, templatesRead)
+	e.GET("/styles/:name", app.handleStyleGet, templatesRead)
+	e.PUT("/styles/:name", app.handleStyleUpload, templatesWrite)
+	e.DELETE("/styles/:name", app.handleStyleDelete, templatesWrite)
 }
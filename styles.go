@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const cslExtension = ".csl"
+
+var (
+	errStyleNotFound    = errors.New("style not found")
+	errInvalidStyleName = errors.New("invalid style name, only letters, numbers, - and _ are allowed")
+	errInvalidStyle     = errors.New("invalid style, expected a CSL style")
+)
+
+// styleInfo describes a CSL style in the style library
+type styleInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// styleStore manages the library of CSL styles. Every style is stored as
+// <name>.csl inside the configured directory.
+type styleStore struct {
+	dir string
+
+	mu sync.RWMutex
+}
+
+func newStyleStore(dir string) *styleStore {
+	return &styleStore{
+		dir: dir,
+	}
+}
+
+// enabled returns true if a styles directory is configured
+func (s *styleStore) enabled() bool {
+	return s.dir != ""
+}
+
+func validateStyleName(name string) error {
+	// styles follow the same naming rules as templates
+	if !templateNameRegex.MatchString(name) {
+		return errInvalidStyleName
+	}
+	return nil
+}
+
+// validateStyle makes sure the content is a XML document with a style root
+// element
+func validateStyle(content []byte) error {
+	decoder := xml.NewDecoder(bytes.NewReader(content))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return errInvalidStyle
+			}
+			return fmt.Errorf("%w: %w", errInvalidStyle, err)
+		}
+		if start, ok := token.(xml.StartElement); ok {
+			if start.Name.Local != "style" {
+				return errInvalidStyle
+			}
+			return nil
+		}
+	}
+}
+
+// list returns all styles in the library
+func (s *styleStore) list() ([]styleInfo, error) {
+	styles := []styleInfo{}
+	if !s.enabled() {
+		return styles, nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return styles, nil
+		}
+		return nil, fmt.Errorf("could not read styles dir: %w", err)
+	}
+	for _, entry := range entries {
+		name, ok := strings.CutSuffix(entry.Name(), cslExtension)
+		if !ok || !entry.Type().IsRegular() || validateStyleName(name) != nil {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("could not stat style %q: %w", entry.Name(), err)
+		}
+		styles = append(styles, styleInfo{
+			Name:      name,
+			Size:      fileInfo.Size(),
+			UpdatedAt: fileInfo.ModTime(),
+		})
+	}
+
+	slices.SortFunc(styles, func(a, b styleInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return styles, nil
+}
+
+// get returns the content of a style
+func (s *styleStore) get(name string) ([]byte, error) {
+	if err := validateStyleName(name); err != nil {
+		return nil, err
+	}
+	if !s.enabled() {
+		return nil, errStyleNotFound
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	content, err := os.ReadFile(filepath.Join(s.dir, name+cslExtension))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errStyleNotFound
+		}
+		return nil, fmt.Errorf("could not read style %q: %w", name, err)
+	}
+	return content, nil
+}
+
+// save stores a style and replaces an existing style with the same name
+func (s *styleStore) save(name string, content []byte) (styleInfo, error) {
+	if err := validateStyleName(name); err != nil {
+		return styleInfo{}, err
+	}
+	if err := validateStyle(content); err != nil {
+		return styleInfo{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return styleInfo{}, fmt.Errorf("could not create styles dir: %w", err)
+	}
+
+	// write to a temporary file first so readers never see a half written style
+	tmpFile, err := os.CreateTemp(s.dir, ".upload-")
+	if err != nil {
+		return styleInfo{}, fmt.Errorf("could not create temporary style file: %w", err)
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := tmpFile.Write(content); err != nil {
+		tmpFile.Close()
+		return styleInfo{}, fmt.Errorf("could not write style: %w", err)
+	}
+	if err := tmpFile.Close(); err != nil {
+		return styleInfo{}, fmt.Errorf("could not write style: %w", err)
+	}
+	if err := os.Rename(tmpFile.Name(), filepath.Join(s.dir, name+cslExtension)); err != nil {
+		return styleInfo{}, fmt.Errorf("could not move style into place: %w", err)
+	}
+
+	return styleInfo{
+		Name:      name,
+		Size:      int64(len(content)),
+		UpdatedAt: time.Now().UTC(),
+	}, nil
+}
+
+// delete removes a style from the library
+func (s *styleStore) delete(name string) error {
+	if err := validateStyleName(name); err != nil {
+		return err
+	}
+	if !s.enabled() {
+		return errStyleNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(filepath.Join(s.dir, name+cslExtension)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return errStyleNotFound
+		}
+		return fmt.Errorf("could not delete style %q: %w", name, err)
+	}
+	return nil
+}
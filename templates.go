@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	templateSourceBuiltin  = "builtin"
+	templateSourceUploaded = "uploaded"
+
+	templateMetadataFilename = "template.json"
+	templateAssetsDirname    = "assets"
+)
+
+var (
+	errTemplateNotFound    = errors.New("template not found")
+	errInvalidTemplateName = errors.New("invalid template name, only letters, numbers, - and _ are allowed")
+	errInvalidTemplate     = errors.New("invalid template")
+	templateNameRegex      = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+	templateFormatRegex    = regexp.MustCompile(`^[a-z0-9]{1,16}$`)
+)
+
+// templateInfo describes an installed template
+type templateInfo struct {
+	Name        string    `json:"name"`
+	Source      string    `json:"source"`
+	Format      string    `json:"format"`
+	Description string    `json:"description,omitempty"`
+	Assets      []string  `json:"assets,omitempty"`
+	Size        int64     `json:"size"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// storedTemplate is an uploaded template including its assets
+type storedTemplate struct {
+	info    templateInfo
+	content []byte
+	assets  map[string][]byte
+}
+
+// templateStore manages the uploaded templates in the templates directory and
+// the builtin templates in the pandoc data dir.
+// Every uploaded template is stored in its own directory containing the
+// template file, a metadata file and the assets.
+type templateStore struct {
+	dir        string
+	builtinDir string
+
+	mu sync.RWMutex
+}
+
+func newTemplateStore(dir, pandocDataDir string) *templateStore {
+	return &templateStore{
+		dir:        dir,
+		builtinDir: filepath.Join(pandocDataDir, "templates"),
+	}
+}
+
+// writable returns true if a templates directory is configured
+func (s *templateStore) writable() bool {
+	return s.dir != ""
+}
+
+func validateTemplateName(name string) error {
+	if !templateNameRegex.MatchString(name) {
+		return errInvalidTemplateName
+	}
+	return nil
+}
+
+// list returns all builtin and uploaded templates
+func (s *templateStore) list() ([]templateInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var templates []templateInfo
+
+	builtin, err := os.ReadDir(s.builtinDir)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("could not read builtin templates: %w", err)
+	}
+	for _, entry := range builtin {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+		fileInfo, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("could not stat builtin template %q: %w", entry.Name(), err)
+		}
+		ext := filepath.Ext(entry.Name())
+		templates = append(templates, templateInfo{
+			Name:      strings.TrimSuffix(entry.Name(), ext),
+			Source:    templateSourceBuiltin,
+			Format:    strings.TrimPrefix(ext, "."),
+			Size:      fileInfo.Size(),
+			UpdatedAt: fileInfo.ModTime(),
+		})
+	}
+
+	if s.writable() {
+		uploaded, err := os.ReadDir(s.dir)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("could not read templates dir: %w", err)
+		}
+		for _, entry := range uploaded {
+			if !entry.IsDir() || validateTemplateName(entry.Name()) != nil {
+				continue
+			}
+			info, err := s.readInfo(entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			templates = append(templates, info)
+		}
+	}
+
+	slices.SortFunc(templates, func(a, b templateInfo) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	return templates, nil
+}
+
+// readInfo reads the metadata of an uploaded template. s.mu must be held.
+func (s *templateStore) readInfo(name string) (templateInfo, error) {
+	content, err := os.ReadFile(filepath.Join(s.dir, name, templateMetadataFilename))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return templateInfo{}, errTemplateNotFound
+		}
+		return templateInfo{}, fmt.Errorf("could not read template metadata for %q: %w", name, err)
+	}
+	var info templateInfo
+	if err := json.Unmarshal(content, &info); err != nil {
+		return templateInfo{}, fmt.Errorf("could not parse template metadata for %q: %w", name, err)
+	}
+	return info, nil
+}
+
+// get returns an uploaded template including the template content and all assets
+func (s *templateStore) get(name string) (storedTemplate, error) {
+	if err := validateTemplateName(name); err != nil {
+		return storedTemplate{}, err
+	}
+	if !s.writable() {
+		return storedTemplate{}, errTemplateNotFound
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	info, err := s.readInfo(name)
+	if err != nil {
+		return storedTemplate{}, err
+	}
+
+	templateDir := filepath.Join(s.dir, name)
+	content, err := os.ReadFile(filepath.Join(templateDir, fmt.Sprintf("template.%s", info.Format)))
+	if err != nil {
+		return storedTemplate{}, fmt.Errorf("could not read template %q: %w", name, err)
+	}
+
+	assets := make(map[string][]byte, len(info.Assets))
+	assetsDir := filepath.Join(templateDir, templateAssetsDirname)
+	for _, asset := range info.Assets {
+		assetPath, err := safeJoin(assetsDir, asset)
+		if err != nil {
+			return storedTemplate{}, err
+		}
+		assetContent, err := os.ReadFile(assetPath)
+		if err != nil {
+			return storedTemplate{}, fmt.Errorf("could not read asset %q of template %q: %w", asset, name, err)
+		}
+		assets[asset] = assetContent
+	}
+
+	return storedTemplate{
+		info:    info,
+		content: content,
+		assets:  assets,
+	}, nil
+}
+
+// builtinExists checks if a builtin template with the given name exists in
+// the pandoc data dir
+func (s *templateStore) builtinExists(name string) (bool, error) {
+	_, err := s.findBuiltin(name)
+	switch {
+	case err == nil:
+		return true, nil
+	case errors.Is(err, errTemplateNotFound), errors.Is(err, errInvalidTemplateName):
+		return false, nil
+	default:
+		return false, err
+	}
+}
+
+// findBuiltin returns the directory entry of the builtin template. The name
+// is matched without the extension as pandoc appends the format if no
+// extension is given.
+func (s *templateStore) findBuiltin(name string) (os.DirEntry, error) {
+	if err := validateTemplateName(name); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(s.builtinDir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, errTemplateNotFound
+		}
+		return nil, fmt.Errorf("could not read builtin templates: %w", err)
+	}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.Type().IsRegular() && strings.TrimSuffix(entry.Name(), ext) == name {
+			return entry, nil
+		}
+	}
+	return nil, errTemplateNotFound
+}
+
+// builtinPath returns the absolute path of the builtin template with the
+// first of the extensions, usually the name of the pandoc writer and the file
+// extension of the output format. errTemplateNotFound is returned if the
+// template does not exist with any of the extensions.
+func (s *templateStore) builtinPath(name string, extensions ...string) (string, error) {
+	if err := validateTemplateName(name); err != nil {
+		return "", err
+	}
+	for _, extension := range extensions {
+		filename := fmt.Sprintf("%s.%s", name, extension)
+		info, err := os.Stat(filepath.Join(s.builtinDir, filename))
+		if errors.Is(err, os.ErrNotExist) || (err == nil && !info.Mode().IsRegular()) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not read builtin template %q: %w", filename, err)
+		}
+		path, err := filepath.Abs(filepath.Join(s.builtinDir, filename))
+		if err != nil {
+			return "", fmt.Errorf("could not get absolute path of builtin template %q: %w", filename, err)
+		}
+		return path, nil
+	}
+	return "", errTemplateNotFound
+}
+
+// getBuiltin returns a builtin template from the pandoc data dir
+func (s *templateStore) getBuiltin(name string) (storedTemplate, error) {
+	entry, err := s.findBuiltin(name)
+	if err != nil {
+		return storedTemplate{}, err
+	}
+
+	fileInfo, err := entry.Info()
+	if err != nil {
+		return storedTemplate{}, fmt.Errorf("could not stat builtin template %q: %w", entry.Name(), err)
+	}
+	content, err := os.ReadFile(filepath.Join(s.builtinDir, entry.Name()))
+	if err != nil {
+		return storedTemplate{}, fmt.Errorf("could not read builtin template %q: %w", entry.Name(), err)
+	}
+	return storedTemplate{
+		info: templateInfo{
+			Name:      name,
+			Source:    templateSourceBuiltin,
+			Format:    strings.TrimPrefix(filepath.Ext(entry.Name()), "."),
+			Size:      fileInfo.Size(),
+			UpdatedAt: fileInfo.ModTime(),
+		},
+		content: content,
+	}, nil
+}
+
+// save stores an uploaded template and replaces an existing template with
+// the same name
+func (s *templateStore) save(name, format, description string, content []byte, assets map[string][]byte) (templateInfo, error) {
+	if err := validateTemplateName(name); err != nil {
+		return templateInfo{}, err
+	}
+	if !templateFormatRegex.MatchString(format) {
+		return templateInfo{}, fmt.Errorf("%w: invalid format %q", errInvalidTemplate, format)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(s.dir, 0750); err != nil {
+		return templateInfo{}, fmt.Errorf("could not create templates dir: %w", err)
+	}
+
+	// write everything to a temporary directory first so we don't end up
+	// with half written templates
+	tmpDir, err := os.MkdirTemp(s.dir, ".upload-")
+	if err != nil {
+		return templateInfo{}, fmt.Errorf("could not create temporary template dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := os.WriteFile(filepath.Join(tmpDir, fmt.Sprintf("template.%s", format)), content, 0600); err != nil {
+		return templateInfo{}, fmt.Errorf("could not write template: %w", err)
+	}
+
+	info := templateInfo{
+		Name:        name,
+		Source:      templateSourceUploaded,
+		Format:      format,
+		Description: description,
+		Size:        int64(len(content)),
+		UpdatedAt:   time.Now().UTC(),
+	}
+
+	assetsDir := filepath.Join(tmpDir, templateAssetsDirname)
+	for assetName, assetContent := range assets {
+		assetPath, err := safeJoin(assetsDir, assetName)
+		if err != nil {
+			return templateInfo{}, fmt.Errorf("%w: %w", errInvalidTemplate, err)
+		}
+		if err := os.MkdirAll(filepath.Dir(assetPath), 0750); err != nil {
+			return templateInfo{}, fmt.Errorf("could not create dir path for asset %q: %w", assetName, err)
+		}
+		if err := os.WriteFile(assetPath, assetContent, 0600); err != nil {
+			return templateInfo{}, fmt.Errorf("could not write asset %q: %w", assetName, err)
+		}
+		relativePath, err := filepath.Rel(assetsDir, assetPath)
+		if err != nil {
+			return templateInfo{}, err
+		}
+		info.Assets = append(info.Assets, filepath.ToSlash(relativePath))
+		info.Size += int64(len(assetContent))
+	}
+	slices.Sort(info.Assets)
+
+	metadata, err := json.Marshal(info)
+	if err != nil {
+		return templateInfo{}, fmt.Errorf("could not marshal template metadata: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, templateMetadataFilename), metadata, 0600); err != nil {
+		return templateInfo{}, fmt.Errorf("could not write template metadata: %w", err)
+	}
+
+	templateDir := filepath.Join(s.dir, name)
+	if err := os.RemoveAll(templateDir); err != nil {
+		return templateInfo{}, fmt.Errorf("could not remove existing template: %w", err)
+	}
+	if err := os.Rename(tmpDir, templateDir); err != nil {
+		return templateInfo{}, fmt.Errorf("could not move template into place: %w", err)
+	}
+
+	return info, nil
+}
+
+// delete removes an uploaded template
+func (s *templateStore) delete(name string) error {
+	if err := validateTemplateName(name); err != nil {
+		return err
+	}
+	if !s.writable() {
+		return errTemplateNotFound
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templateDir := filepath.Join(s.dir, name)
+	if _, err := os.Stat(templateDir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return errTemplateNotFound
+		}
+		return err
+	}
+	return os.RemoveAll(templateDir)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"github.com/labstack/echo/v5"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is used for all spans. It uses the global tracer provider so spans
+// are dropped if tracing is not configured.
+var tracer = otel.Tracer("github.com/firefart/pandocserver")
+
+// setupTracing configures the W3C trace context propagation and, if an
+// endpoint is configured, the export of spans via OTLP/HTTP. The returned
+// function flushes the remaining spans and needs to be called on shutdown.
+func setupTracing(ctx context.Context, configuration config.ConfigTracing, logger *slog.Logger) (func(context.Context) error, error) {
+	// incoming trace context is always propagated, even if we don't export
+	// our own spans
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if configuration.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpointURL(configuration.Endpoint),
+	}
+	if configuration.Insecure {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	exporter, err := otlptracehttp.New(ctx, options...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace exporter: %w", err)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithAttributes(semconv.ServiceName(configuration.ServiceName)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("could not create trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(configuration.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Error("error on tracing", slog.String("err", err.Error()))
+	}))
+
+	return provider.Shutdown, nil
+}
+
+// endSpan records the error if there is one and ends the span
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// middlewareTracing starts a server span for every request. The trace context
+// sent by the client is used as the parent.
+func (app *application) middlewareTracing() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c *echo.Context) error {
+			req := c.Request()
+			ctx := otel.GetTextMapPropagator().Extract(req.Context(), propagation.HeaderCarrier(req.Header))
+
+			route := c.Path()
+			if route == "" {
+				route = req.URL.Path
+			}
+			ctx, span := tracer.Start(ctx, fmt.Sprintf("%s %s", req.Method, route),
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					semconv.HTTPRequestMethodKey.String(req.Method),
+					semconv.HTTPRoute(route),
+					semconv.URLPath(req.URL.Path),
+				),
+			)
+			defer span.End()
+			c.SetRequest(req.WithContext(ctx))
+
+			err := next(c)
+
+			// the request logger sits behind this middleware and already
+			// called the error handler, so the final status is known here
+			if resp, uErr := echo.UnwrapResponse(c.Response()); uErr == nil {
+				span.SetAttributes(semconv.HTTPResponseStatusCode(resp.Status))
+				if resp.Status >= http.StatusInternalServerError {
+					span.SetStatus(codes.Error, http.StatusText(resp.Status))
+				}
+			}
+			return err
+		}
+	}
+}
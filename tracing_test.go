@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/firefart/pandocserver/internal/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+	collectortracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// the global tracer only delegates to the first provider set, so all tracing
+// tests share the provider created by setupTracing. It exports to a stub
+// collector and additionally records the spans in memory.
+func TestTracing(t *testing.T) {
+	collector := newStubCollector(t)
+	shutdown, err := setupTracing(t.Context(), config.ConfigTracing{
+		Endpoint:    collector.URL + "/v1/traces",
+		Insecure:    true,
+		ServiceName: "pandocserver-test",
+		SampleRatio: 1,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = shutdown(context.WithoutCancel(t.Context())) })
+	provider, ok := otel.GetTracerProvider().(*sdktrace.TracerProvider)
+	if !ok {
+		t.Fatalf("unexpected tracer provider %T", otel.GetTracerProvider())
+	}
+	recorder := tracetest.NewSpanRecorder()
+	provider.RegisterSpanProcessor(recorder)
+
+	const (
+		traceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+		parentSpanID = "00f067aa0ba902b7"
+	)
+	header := http.Header{"Traceparent": {"00-" + traceID + "-" + parentSpanID + "-01"}}
+
+	t.Run("spans use the incoming trace context", func(t *testing.T) {
+		recorder.Reset()
+		app := newTestApplication(t, &instrumentedConverter{next: &fakeConverter{}}, nil)
+		rec := postJSON(t, app.newServer(), "/convert", map[string]any{"input": []byte("x"), "output_format": "html"}, header)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+
+		spans := recorder.Ended()
+		byName := make(map[string]sdktrace.ReadOnlySpan)
+		for _, span := range spans {
+			if got := span.SpanContext().TraceID().String(); got != traceID {
+				t.Errorf("span %q has trace id %s, expected %s", span.Name(), got, traceID)
+			}
+			byName[span.Name()] = span
+		}
+
+		server, ok := byName["POST /convert"]
+		if !ok {
+			t.Fatalf("no server span recorded, got %d spans", len(spans))
+		}
+		if server.SpanKind() != trace.SpanKindServer {
+			t.Errorf("expected a server span, got %s", server.SpanKind())
+		}
+		if got := server.Parent().SpanID().String(); got != parentSpanID || !server.Parent().IsRemote() {
+			t.Errorf("expected the remote parent %s, got %s", parentSpanID, got)
+		}
+		if !hasAttribute(server, semconv.HTTPResponseStatusCode(http.StatusOK)) {
+			t.Errorf("status code attribute missing: %v", server.Attributes())
+		}
+
+		for _, name := range []string{"bind request", "validate request", "wait for worker", "convert", "send response"} {
+			span, ok := byName[name]
+			if !ok {
+				t.Errorf("span %q was not recorded", name)
+				continue
+			}
+			if span.Parent().SpanID() != server.SpanContext().SpanID() {
+				t.Errorf("span %q is not a child of the server span", name)
+			}
+		}
+	})
+
+	// only server errors mark the span as failed
+	for _, tt := range []struct {
+		err    error
+		status int
+		code   codes.Code
+	}{
+		{err: errors.New("pandoc crashed"), status: http.StatusBadRequest, code: codes.Unset},
+		{err: errJobStorageFull, status: http.StatusServiceUnavailable, code: codes.Error},
+	} {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			recorder.Reset()
+			app := newTestApplication(t, &instrumentedConverter{next: &fakeConverter{err: tt.err}}, nil)
+			rec := postJSON(t, app.newServer(), "/convert", map[string]any{"input": []byte("x"), "output_format": "html"}, header)
+			if rec.Code != tt.status {
+				t.Fatalf("expected status %d, got %d: %s", tt.status, rec.Code, rec.Body.String())
+			}
+
+			for _, span := range recorder.Ended() {
+				if span.Name() != "POST /convert" {
+					continue
+				}
+				if span.Status().Code != tt.code {
+					t.Errorf("expected span status %s, got %v", tt.code, span.Status())
+				}
+				if !hasAttribute(span, semconv.HTTPResponseStatusCode(tt.status)) {
+					t.Errorf("status code attribute missing: %v", span.Attributes())
+				}
+				return
+			}
+			t.Fatal("no server span recorded")
+		})
+	}
+
+	// needs to run last as it shuts down the provider
+	t.Run("spans are exported", func(t *testing.T) {
+		app := newTestApplication(t, &instrumentedConverter{next: &fakeConverter{}}, nil)
+		rec := postJSON(t, app.newServer(), "/convert", map[string]any{"input": []byte("x"), "output_format": "html"}, header)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d: %s", rec.Code, rec.Body.String())
+		}
+		// flushes the batched spans
+		if err := shutdown(t.Context()); err != nil {
+			t.Fatal(err)
+		}
+
+		var service string
+		spans := make(map[string]*tracepb.Span)
+		for _, req := range collector.requests() {
+			for _, resourceSpans := range req.GetResourceSpans() {
+				for _, attr := range resourceSpans.GetResource().GetAttributes() {
+					if attr.GetKey() == string(semconv.ServiceNameKey) {
+						service = attr.GetValue().GetStringValue()
+					}
+				}
+				for _, scopeSpans := range resourceSpans.GetScopeSpans() {
+					for _, span := range scopeSpans.GetSpans() {
+						spans[span.GetName()] = span
+					}
+				}
+			}
+		}
+		if service != "pandocserver-test" {
+			t.Errorf("expected service name pandocserver-test, got %q", service)
+		}
+		span, ok := spans["POST /convert"]
+		if !ok {
+			t.Fatalf("server span was not exported, got %d spans", len(spans))
+		}
+		if got := hex.EncodeToString(span.GetTraceId()); got != traceID {
+			t.Errorf("exported span has trace id %s, expected %s", got, traceID)
+		}
+		if got := hex.EncodeToString(span.GetParentSpanId()); got != parentSpanID {
+			t.Errorf("exported span has parent %s, expected %s", got, parentSpanID)
+		}
+		if span.GetKind() != tracepb.Span_SPAN_KIND_SERVER {
+			t.Errorf("expected a server span, got %s", span.GetKind())
+		}
+	})
+}
+
+// stubCollector is an OTLP/HTTP collector that records the exported traces
+type stubCollector struct {
+	*httptest.Server
+	mu       sync.Mutex
+	received []*collectortracepb.ExportTraceServiceRequest
+}
+
+func newStubCollector(t *testing.T) *stubCollector {
+	t.Helper()
+	c := &stubCollector{}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		req := &collectortracepb.ExportTraceServiceRequest{}
+		if err := proto.Unmarshal(body, req); err != nil {
+			t.Errorf("invalid export request: %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c.mu.Lock()
+		c.received = append(c.received, req)
+		c.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		resp, _ := proto.Marshal(&collectortracepb.ExportTraceServiceResponse{})
+		_, _ = w.Write(resp)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *stubCollector) requests() []*collectortracepb.ExportTraceServiceRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return slices.Clone(c.received)
+}
+
+func hasAttribute(span sdktrace.ReadOnlySpan, want attribute.KeyValue) bool {
+	for _, attr := range span.Attributes() {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"syscall"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+var webhookSignatureHeaderName = http.CanonicalHeaderKey("X-Pandocserver-Signature")
+
+// sharedAddressSpace is the carrier-grade NAT range of RFC 6598
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+// webhookSender posts job results to client supplied callback urls
+type webhookSender struct {
+	logger       *slog.Logger
+	client       *http.Client
+	secret       []byte
+	retries      int
+	backoff      time.Duration
+	allowedHosts []string
+	// allowPrivateNetworks allows callbacks to loopback, private and
+	// link-local addresses
+	allowPrivateNetworks bool
+}
+
+func newWebhookSender(configuration config.ConfigWebhooks, logger *slog.Logger) *webhookSender {
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	if !configuration.AllowPrivateNetworks {
+		// the address is checked after the DNS resolution so hostnames
+		// pointing to internal addresses are also rejected
+		dialer.Control = dialPublicOnly
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would connect to the callback url on our behalf and bypass the
+	// address check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &webhookSender{
+		logger: logger,
+		client: &http.Client{
+			Timeout:   configuration.Timeout,
+			Transport: transport,
+			// a redirect could point to an internal address or a host that
+			// is not allowed
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		secret:               []byte(configuration.Secret),
+		retries:              configuration.Retries,
+		backoff:              configuration.Backoff,
+		allowedHosts:         configuration.AllowedHosts,
+		allowPrivateNetworks: configuration.AllowPrivateNetworks,
+	}
+}
+
+// enabled returns true if a secret is configured. Callbacks are only sent if
+// they can be signed.
+func (w *webhookSender) enabled() bool {
+	return len(w.secret) > 0
+}
+
+// validateURL checks if the callback url can be used
+func (w *webhookSender) validateURL(callbackURL string) error {
+	if !w.enabled() {
+		return fmt.Errorf("callbacks are not configured on this server")
+	}
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return fmt.Errorf("invalid callback url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid callback url scheme %q", u.Scheme)
+	}
+	if len(w.allowedHosts) > 0 && !slices.Contains(w.allowedHosts, u.Hostname()) {
+		return fmt.Errorf("callback host %q is not allowed", u.Hostname())
+	}
+	// hostnames are checked when connecting
+	if ip, err := netip.ParseAddr(u.Hostname()); err == nil && !w.allowPrivateNetworks && !isPublicIP(ip) {
+		return fmt.Errorf("callback host %q is not a public address", u.Hostname())
+	}
+	return nil
+}
+
+// isPublicIP returns false for loopback, private, link-local and other
+// addresses that are not reachable on the internet
+func isPublicIP(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !sharedAddressSpace.Contains(ip)
+}
+
+// dialPublicOnly is used as the net.Dialer Control function and only allows
+// connections to public addresses
+func dialPublicOnly(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("invalid address %q: %w", address, err)
+	}
+	if !isPublicIP(addrPort.Addr()) {
+		return fmt.Errorf("connections to %s are not allowed", addrPort.Addr())
+	}
+	return nil
+}
+
+// sign returns the HMAC-SHA256 signature of the body as sent in the signature header
+func (w *webhookSender) sign(body []byte) string {
+	mac := hmac.New(sha256.New, w.secret)
+	mac.Write(body)
+	return fmt.Sprintf("sha256=%s", hex.EncodeToString(mac.Sum(nil)))
+}
+
+// send posts the payload as JSON to the callback url. Failed requests are
+// retried with an exponential backoff until the configured number of retries
+// is reached or ctx is done.
+func (w *webhookSender) send(ctx context.Context, callbackURL string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("could not marshal callback payload: %w", err)
+	}
+	signature := w.sign(body)
+
+	backoff := w.backoff
+	for attempt := 0; ; attempt++ {
+		err = w.post(ctx, callbackURL, body, signature)
+		if err == nil {
+			return nil
+		}
+		if attempt >= w.retries {
+			return fmt.Errorf("giving up after %d attempts: %w", attempt+1, err)
+		}
+		w.logger.DebugContext(ctx, "callback failed, retrying", slog.String("url", callbackURL), slog.Duration("backoff", backoff), slog.String("err", err.Error()))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (w *webhookSender) post(ctx context.Context, callbackURL string, body []byte, signature string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("could not create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeaderName, signature)
+	if requestID := requestIDFromContext(ctx); requestID != "" {
+		req.Header.Set(requestIDHeaderName, requestID)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("callback returned status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/firefart/pandocserver/internal/config"
+)
+
+func testWebhookSender(allowPrivateNetworks bool) *webhookSender {
+	return newWebhookSender(config.ConfigWebhooks{
+		Secret:               "secret",
+		Timeout:              5 * time.Second,
+		AllowPrivateNetworks: allowPrivateNetworks,
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+func TestIsPublicIP(t *testing.T) {
+	tests := []struct {
+		ip     string
+		public bool
+	}{
+		{"8.8.8.8", true},
+		{"2001:4860:4860::8888", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"100.64.0.1", false},
+		{"0.0.0.0", false},
+		{"::ffff:127.0.0.1", false},
+		{"224.0.0.1", false},
+	}
+	for _, tt := range tests {
+		if got := isPublicIP(netip.MustParseAddr(tt.ip)); got != tt.public {
+			t.Errorf("isPublicIP(%s) = %t, want %t", tt.ip, got, tt.public)
+		}
+	}
+}
+
+func TestWebhookValidateURL(t *testing.T) {
+	w := testWebhookSender(false)
+	for _, u := range []string{"http://127.0.0.1/cb", "http://[::1]/cb", "http://169.254.169.254/latest", "ftp://example.com/cb"} {
+		if err := w.validateURL(u); err == nil {
+			t.Errorf("validateURL(%q) returned no error", u)
+		}
+	}
+	if err := w.validateURL("https://example.com/cb"); err != nil {
+		t.Errorf("validateURL returned an error for a public host: %v", err)
+	}
+
+	if err := testWebhookSender(true).validateURL("http://127.0.0.1/cb"); err != nil {
+		t.Errorf("validateURL returned an error with allow_private_networks: %v", err)
+	}
+}
+
+func TestWebhookRejectsPrivateAddresses(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	// "localhost" passes validateURL, the check happens after resolving it
+	srvURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := "http://localhost:" + srvURL.Port()
+	if err := testWebhookSender(false).post(context.Background(), u, []byte("{}"), "sig"); err == nil {
+		t.Fatal("expected an error when posting to a loopback address")
+	}
+	if called {
+		t.Fatal("callback was sent to a loopback address")
+	}
+
+	if err := testWebhookSender(true).post(context.Background(), u, []byte("{}"), "sig"); err != nil {
+		t.Fatalf("post with allow_private_networks failed: %v", err)
+	}
+	if !called {
+		t.Fatal("callback was not sent")
+	}
+}
+
+func TestWebhookDoesNotFollowRedirects(t *testing.T) {
+	redirected := false
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		redirected = true
+	}))
+	defer target.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, target.URL, http.StatusTemporaryRedirect)
+	}))
+	defer srv.Close()
+
+	if err := testWebhookSender(true).post(context.Background(), srv.URL, []byte("{}"), "sig"); err == nil {
+		t.Fatal("expected an error for a redirect")
+	}
+	if redirected {
+		t.Fatal("redirect was followed")
+	}
+}